@@ -0,0 +1,76 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const aliasPrefix = "aliases/"
+
+var aliasesEnabled bool
+var aliasCacheControl = "no-cache"
+var logicalIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+(/[A-Za-z0-9_-]+)*$`)
+
+var errOtherTenant = errors.New("Invalid logical_id: inside another tenant's prefix")
+
+var errLogicalID = errors.New("Invalid logical_id: use letters, digits, - and _, optionally in /-separated segments, up to 200 characters")
+
+func initAliases() {
+	aliasesEnabled = envBool("ALIAS_UPLOADS")
+	if v, ok := lookupEnv("ALIAS_CACHE_CONTROL"); ok {
+		aliasCacheControl = v
+	}
+}
+
+// aliasKeyFor returns the stable key for logicalID, or "" when aliases are
+// off or no logical ID was sent. The alias lives next to the tenant's upload
+// prefix and carries the upload's extension.
+func aliasKeyFor(label, logicalID, filename string) (string, error) {
+	if !aliasesEnabled || logicalID == "" {
+		return "", nil
+	}
+	if err := checkLogicalID(logicalID); err != nil {
+		return "", err
+	}
+	key := sidePrefixFor(label, aliasPrefix) + logicalID + strings.ToLower(filepath.Ext(filename))
+	if inOtherTenant(label, key) {
+		return "", errOtherTenant
+	}
+	return key, nil
+}
+
+func checkLogicalID(logicalID string) error {
+	if len(logicalID) > 200 || !logicalIDPattern.MatchString(logicalID) {
+		return errLogicalID
+	}
+	return nil
+}
+
+// updateAlias copies key over alias on whichever backend holds key. The
+// headers are replaced rather than copied so the alias gets its own
+// Cache-Control: versioned keys never change, but the alias does.
+func updateAlias(ctx context.Context, key, alias string, meta map[string]string) (string, error) {
+	headers := &ObjectHeaders{
+		ContentType:  detectContentType(alias),
+		CacheControl: aliasCacheControl,
+		Metadata:     meta,
+	}
+
+	// While the breaker is open, new objects can only be on the fallback.
+	err := errCircuitOpen
+	if uploadBreaker.retryAfter() == 0 {
+		if err = storage.Copy(ctx, key, alias, headers); err == nil {
+			return objectURL(ctx, alias)
+		}
+	}
+	if fallback == nil {
+		return "", err
+	}
+	if fbErr := fallback.Copy(ctx, key, alias, headers); fbErr != nil {
+		return "", err
+	}
+	return fallback.PublicURL(ctx, alias)
+}
@@ -0,0 +1,299 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Async uploads (?async=true) are answered with a job ID as soon as the form
+// is parsed and checked, then stored by a pool of ASYNC_WORKERS workers.
+// Jobs live in memory: a restart loses queued ones, and finished ones are
+// dropped JOB_TTL after they complete.
+var (
+	asyncWorkers   = 4
+	asyncQueueSize = 100
+	jobTTL         = time.Hour
+)
+
+// asyncPool is a Server's queue, workers and jobs. Once close has run, new
+// jobs are refused rather than sent on the closed queue.
+type asyncPool struct {
+	mu      sync.Mutex
+	queue   chan *asyncJob
+	closed  bool
+	running sync.WaitGroup
+	jobs    map[string]*asyncJob
+}
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// asyncJob is one queued /upload batch and the status /jobs/{id} reports.
+type asyncJob struct {
+	mu        sync.Mutex
+	id        string
+	pool      *asyncPool
+	upload    *uploadJob
+	form      *uploadForm
+	files     []*formFile
+	reserved  int64
+	state     string
+	entries   []JobFile
+	result    *ApiResponse
+	createdAt time.Time
+	updatedAt time.Time
+}
+
+type JobFile struct {
+	Index    int    `json:"index"`
+	Original string `json:"original"`
+	State    string `json:"state"`
+	Key      string `json:"key,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type JobResponse struct {
+	Status    int       `json:"status"`
+	JobID     string    `json:"job_id"`
+	State     string    `json:"state"`
+	Total     int       `json:"total"`
+	Completed int       `json:"completed"`
+	Failed    int       `json:"failed"`
+	Files     []JobFile `json:"files"`
+	// Result is the response a synchronous upload would have returned, set
+	// once the job is done.
+	Result    *ApiResponse `json:"result,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+type JobAccepted struct {
+	Status    int    `json:"status"`
+	Message   string `json:"message"`
+	JobID     string `json:"job_id"`
+	StatusURL string `json:"status_url"`
+}
+
+func initAsync() *asyncPool {
+	asyncWorkers = envInt("ASYNC_WORKERS", asyncWorkers)
+	asyncQueueSize = envInt("ASYNC_QUEUE_SIZE", asyncQueueSize)
+	jobTTL = envDuration("JOB_TTL", jobTTL)
+	pool := &asyncPool{queue: make(chan *asyncJob, asyncQueueSize), jobs: map[string]*asyncJob{}}
+	for range asyncWorkers {
+		pool.running.Go(func() {
+			for job := range pool.queue {
+				job.run()
+			}
+		})
+	}
+	return pool
+}
+
+func parseAsync(v string) (bool, error) {
+	if v == "" {
+		return false, nil
+	}
+	async, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errors.New("async must be true or false")
+	}
+	return async, nil
+}
+
+// enqueueUpload queues an upload the handler has validated and reserved
+// quota for, and answers 202 with the job ID. It reports whether the job
+// took the form, whose temp files it then removes once it has run. A full
+// or closed queue answers 503 and hands the quota back.
+func enqueueUpload(w http.ResponseWriter, upload *uploadJob, form *uploadForm, files []*formFile, reserved int64) bool {
+	var pool *asyncPool
+	if s := serverFrom(upload.r); s != nil {
+		pool = s.async
+	}
+	now := time.Now()
+	job := &asyncJob{
+		id:        strings.ReplaceAll(uuid.NewString(), "-", ""),
+		pool:      pool,
+		upload:    upload,
+		form:      form,
+		files:     files,
+		reserved:  reserved,
+		state:     jobQueued,
+		entries:   make([]JobFile, len(files)),
+		createdAt: now,
+		updatedAt: now,
+	}
+	for i, fileHeader := range files {
+		job.entries[i] = JobFile{Index: i, Original: fileHeader.Filename, State: jobQueued}
+	}
+	upload.status = job
+
+	if !pool.add(job) {
+		releaseQuota(upload.label, reserved)
+		releaseDailyQuota(upload.label, reserved)
+		w.Header().Set("Retry-After", "5")
+		sendJSONMulti(w, 503, nil, nil, "Upload queue is full or shutting down, try again later")
+		return false
+	}
+
+	statusURL := "/jobs/" + job.id
+	w.Header().Set("Location", statusURL)
+	sendJSON(w, 202, JobAccepted{
+		Status:    202,
+		Message:   strconv.Itoa(len(files)) + " image(s) queued",
+		JobID:     job.id,
+		StatusURL: statusURL,
+	})
+	return true
+}
+
+// add registers job and queues it, unless the queue is full or closed.
+func (pool *asyncPool) add(job *asyncJob) bool {
+	if pool == nil {
+		return false
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.closed {
+		return false
+	}
+	select {
+	case pool.queue <- job:
+		pool.jobs[job.id] = job
+		return true
+	default:
+		return false
+	}
+}
+
+func (pool *asyncPool) job(id string) *asyncJob {
+	if pool == nil {
+		return nil
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return pool.jobs[id]
+}
+
+// run stores the batch under BATCH_TIMEOUT, like a synchronous request, but
+// without the request's context: the client has already gone.
+func (job *asyncJob) run() {
+	job.setState(jobRunning)
+	ctx, cancel := withOptionalTimeout(context.Background(), batchTimeout)
+	job.upload.ctx = ctx
+	resp := job.upload.run(job.files, job.reserved)
+	cancel()
+	removeForm(job.form)
+
+	job.mu.Lock()
+	job.result = &resp
+	job.state = jobDone
+	if len(resp.URLs) == 0 {
+		job.state = jobFailed
+	}
+	job.updatedAt = time.Now()
+	job.mu.Unlock()
+	time.AfterFunc(jobTTL, func() {
+		job.pool.mu.Lock()
+		delete(job.pool.jobs, job.id)
+		job.pool.mu.Unlock()
+	})
+}
+
+func (job *asyncJob) setState(state string) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.state = state
+	job.updatedAt = time.Now()
+}
+
+// startFile and finishFile are called by uploadJob.run for each file. Both
+// are no-ops on synchronous uploads, which have no job.
+func (job *asyncJob) startFile(i int) {
+	if job == nil {
+		return
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.entries[i].State = jobRunning
+	job.updatedAt = time.Now()
+}
+
+func (job *asyncJob) finishFile(i int, outcome fileOutcome) {
+	if job == nil {
+		return
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	entry := &job.entries[i]
+	if f := outcome.failure; f != nil {
+		entry.State, entry.Reason, entry.Error = jobFailed, f.Reason, f.Message
+	} else {
+		entry.State, entry.Key, entry.URL, entry.Size = jobDone, outcome.result.Key, outcome.result.URL, outcome.result.StoredSize
+	}
+	job.updatedAt = time.Now()
+}
+
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) || !allowOperation(w, r, opUpload) {
+		return
+	}
+
+	var job *asyncJob
+	if s := serverFrom(r); s != nil {
+		job = s.async.job(strings.TrimPrefix(r.URL.Path, "/jobs/"))
+	}
+	// Another key's job reads as unknown rather than forbidden.
+	if job == nil || job.upload.label != keyLabel(r) {
+		sendJSON(w, 404, map[string]interface{}{"status": 404, "message": "Unknown or expired job"})
+		return
+	}
+
+	job.mu.Lock()
+	resp := JobResponse{
+		Status:    200,
+		JobID:     job.id,
+		State:     job.state,
+		Total:     len(job.entries),
+		Files:     slices.Clone(job.entries),
+		Result:    job.result,
+		CreatedAt: job.createdAt,
+		UpdatedAt: job.updatedAt,
+	}
+	job.mu.Unlock()
+	for _, entry := range resp.Files {
+		switch entry.State {
+		case jobDone:
+			resp.Completed++
+		case jobFailed:
+			resp.Failed++
+		}
+	}
+	sendJSON(w, 200, resp)
+}
+
+// drain stops taking jobs and waits for the queued and running ones. An
+// upload that arrives afterwards is answered 503.
+func (pool *asyncPool) drain() {
+	pool.mu.Lock()
+	if !pool.closed {
+		pool.closed = true
+		close(pool.queue)
+	}
+	pool.mu.Unlock()
+	pool.running.Wait()
+}
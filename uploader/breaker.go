@@ -0,0 +1,147 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// circuitBreaker fast-fails R2 writes after threshold failures within window,
+// then lets a single trial request through once cooldown has passed.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	state     string
+	failures  []time.Time
+	openedAt  time.Time
+	trial     bool
+}
+
+type BreakerStatus struct {
+	State     string     `json:"state"`
+	Failures  int        `json:"failures"`
+	Threshold int        `json:"threshold"`
+	OpenUntil *time.Time `json:"open_until,omitempty"`
+}
+
+var uploadBreaker *circuitBreaker
+
+func initBreaker() {
+	threshold := envIntMin("BREAKER_FAILURE_THRESHOLD", 0, 0)
+	if threshold == 0 {
+		return
+	}
+	uploadBreaker = &circuitBreaker{
+		threshold: threshold,
+		window:    envDuration("BREAKER_WINDOW", time.Minute),
+		cooldown:  envDuration("BREAKER_COOLDOWN", 30*time.Second),
+		state:     breakerClosed,
+	}
+}
+
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		log.Println("⚡ Circuit breaker half-open, testing R2")
+		fallthrough
+	case breakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	}
+	return true
+}
+
+func (b *circuitBreaker) record(err error) {
+	if b == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.trial = false
+		if err == nil {
+			b.state = breakerClosed
+			b.failures = nil
+			log.Println("⚡ Circuit breaker closed, R2 recovered")
+		} else {
+			b.trip()
+		}
+		return
+	}
+	if err == nil {
+		return
+	}
+
+	now := time.Now()
+	b.failures = append(b.failures, now)
+	for len(b.failures) > 0 && now.Sub(b.failures[0]) > b.window {
+		b.failures = b.failures[1:]
+	}
+	if len(b.failures) >= b.threshold {
+		b.trip()
+	}
+}
+
+func (b *circuitBreaker) trip() {
+	b.state = breakerOpen
+	b.openedAt = time.Now()
+	b.failures = nil
+	log.Printf("⚡ Circuit breaker open for %s after repeated R2 failures", b.cooldown)
+}
+
+// retryAfter reports how long until the breaker will accept a trial request,
+// or zero when uploads are currently allowed.
+func (b *circuitBreaker) retryAfter() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerOpen {
+		return 0
+	}
+	if remaining := b.cooldown - time.Since(b.openedAt); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+func (b *circuitBreaker) status() *BreakerStatus {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := &BreakerStatus{State: b.state, Failures: len(b.failures), Threshold: b.threshold}
+	if b.state == breakerOpen {
+		until := b.openedAt.Add(b.cooldown)
+		status.OpenUntil = &until
+	}
+	return status
+}
@@ -0,0 +1,32 @@
+package uploader
+
+import "time"
+
+// processingBudget bounds the time spent on a file before its optional
+// steps are skipped; 0 disables the budget.
+var processingBudget time.Duration
+
+func initProcessingBudget() {
+	processingBudget = envDuration("PROCESSING_BUDGET", processingBudget)
+}
+
+// fileBudget tracks one file's budget. Validation always runs and counts
+// toward it; only the steps asked about through allow can be skipped.
+type fileBudget struct {
+	start   time.Time
+	skipped []string
+}
+
+func newFileBudget() *fileBudget {
+	return &fileBudget{start: time.Now()}
+}
+
+// allow reports whether an optional step still fits in the budget and
+// records it as skipped when it doesn't.
+func (b *fileBudget) allow(step string) bool {
+	if processingBudget == 0 || time.Since(b.start) < processingBudget {
+		return true
+	}
+	b.skipped = append(b.skipped, step)
+	return false
+}
@@ -0,0 +1,108 @@
+package uploader
+
+var camelCaseFields bool
+
+func initResponseCase() {
+	switch getenv("RESPONSE_FIELD_CASE") {
+	case "", "snake":
+	case "camel":
+		camelCaseFields = true
+	default:
+		fatal("Invalid RESPONSE_FIELD_CASE: must be snake or camel")
+	}
+}
+
+// camelizeKeys rewrites the object keys of encoded JSON from snake_case to
+// camelCase in place of a second set of struct tags. It walks the bytes
+// rather than decoding, so field order is kept and string values, which may
+// contain underscores, are left alone. The objects under mapFields are
+// copied as is: their keys are names the client chose, not field names.
+func camelizeKeys(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		if data[i] != '"' {
+			out = append(out, data[i])
+			continue
+		}
+		end := i + 1
+		for end < len(data) && data[end] != '"' {
+			if data[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		next := end + 1
+		for next < len(data) && (data[next] == ' ' || data[next] == '\n' || data[next] == '\t' || data[next] == '\r') {
+			next++
+		}
+		if next < len(data) && data[next] == ':' {
+			out = append(out, '"')
+			out = append(out, snakeToCamel(data[i+1:end])...)
+			out = append(out, '"')
+			if mapFields[string(data[i+1:end])] {
+				skip := skipJSONValue(data, next+1)
+				out = append(out, data[end+1:skip]...)
+				i = skip - 1
+				continue
+			}
+		} else {
+			out = append(out, data[i:end+1]...)
+		}
+		i = end
+	}
+	return out
+}
+
+// mapFields are the response fields holding maps keyed by client input.
+var mapFields = map[string]bool{"variants": true, "variant_quality": true, "headers": true}
+
+// skipJSONValue returns the offset just past the JSON value starting at or
+// after i.
+func skipJSONValue(data []byte, i int) int {
+	depth := 0
+	for ; i < len(data); i++ {
+		switch data[i] {
+		case '"':
+			for i++; i < len(data) && data[i] != '"'; i++ {
+				if data[i] == '\\' {
+					i++
+				}
+			}
+			if depth == 0 {
+				return i + 1
+			}
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+			if depth < 0 {
+				return i
+			}
+		case ',':
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return i
+}
+
+func snakeToCamel(key []byte) []byte {
+	out := make([]byte, 0, len(key))
+	upper := false
+	for _, c := range key {
+		if c == '_' && len(out) > 0 {
+			upper = true
+			continue
+		}
+		if upper && c >= 'a' && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		upper = false
+		out = append(out, c)
+	}
+	return out
+}
@@ -0,0 +1,39 @@
+package uploader
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+)
+
+var contentMD5 bool
+
+// fileDigests holds a file's hashes. The MD5 is only filled in with
+// CONTENT_MD5.
+type fileDigests struct {
+	MD5Hex    string
+	MD5Base64 string // the form the Content-MD5 header requires
+	SHA256Hex string
+}
+
+func hashingEnabled() bool {
+	return contentMD5 || receiptsEnabled() || usesContentHash()
+}
+
+// digestFile computes every digest in a single read of r.
+func digestFile(r io.Reader) (fileDigests, error) {
+	md5Hash, shaHash := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5Hash, shaHash), r); err != nil {
+		return fileDigests{}, err
+	}
+	var d fileDigests
+	if contentMD5 {
+		sum := md5Hash.Sum(nil)
+		d.MD5Hex = hex.EncodeToString(sum)
+		d.MD5Base64 = base64.StdEncoding.EncodeToString(sum)
+	}
+	d.SHA256Hex = hex.EncodeToString(shaHash.Sum(nil))
+	return d, nil
+}
@@ -0,0 +1,95 @@
+package uploader
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// settings holds the Config.Settings of the running Server. Names found here
+// win over the process environment.
+var settings map[string]string
+
+func lookupEnv(name string) (string, bool) {
+	if v, ok := settings[name]; ok {
+		return v, true
+	}
+	return os.LookupEnv(name)
+}
+
+func getenv(name string) string {
+	v, _ := lookupEnv(name)
+	return v
+}
+
+// configError carries an invalid setting out of the init functions; New
+// recovers it and returns it as an error.
+type configError struct{ msg string }
+
+func (e configError) Error() string { return e.msg }
+
+func fatal(v ...any) {
+	panic(configError{fmt.Sprint(v...)})
+}
+
+func fatalf(format string, v ...any) {
+	panic(configError{fmt.Sprintf(format, v...)})
+}
+
+func envInt(name string, def int) int {
+	return envIntMin(name, def, 1)
+}
+
+// envIntMin is envInt for settings where values below 1 mean something,
+// usually 0 for "off" or "no limit".
+func envIntMin(name string, def, min int) int {
+	v := getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min {
+		if min == 1 {
+			fatalf("Invalid %s: must be a positive integer", name)
+		}
+		fatalf("Invalid %s: must be an integer of at least %d", name, min)
+	}
+	return n
+}
+
+func envStatus(name string, def int) int {
+	status := envInt(name, def)
+	if status < 400 || status > 599 {
+		fatalf("Invalid %s: must be an HTTP error status (400-599)", name)
+	}
+	return status
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	v := getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		fatalf("Invalid %s: must be a duration like 30s or 5m", name)
+	}
+	return d
+}
+
+func envBool(name string) bool {
+	v := strings.ToLower(getenv(name))
+	return v == "true" || v == "1" || v == "yes"
+}
+
+func envList(name string) []string {
+	var list []string
+	for _, item := range strings.Split(getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
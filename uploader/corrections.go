@@ -0,0 +1,70 @@
+package uploader
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+var logTypeCorrections bool
+
+// TypeCorrection counts the uploads from one key label whose extension said
+// From but whose content was To. From is "none" when the name had no
+// extension.
+type TypeCorrection struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	KeyLabel string `json:"key_label"`
+	Count    int64  `json:"count"`
+}
+
+type correctionKey struct {
+	from, to, label string
+}
+
+var typeCorrections = struct {
+	sync.Mutex
+	counts map[correctionKey]int64
+}{counts: map[correctionKey]int64{}}
+
+// recordTypeCorrection notes that a filename's extension was replaced or
+// filled in from the sniffed type. Only the types and the caller are
+// logged, never the filename or content.
+func recordTypeCorrection(r *http.Request, from, to string) {
+	if from == "" {
+		from = "none"
+	}
+	label := keyLabel(r)
+	typeCorrections.Lock()
+	typeCorrections.counts[correctionKey{from, to, label}]++
+	typeCorrections.Unlock()
+
+	if logTypeCorrections {
+		slog.Info("content type corrected",
+			"request_id", requestID(r),
+			"path", r.URL.Path,
+			"key_label", label,
+			"from_type", from,
+			"to_type", to,
+		)
+	}
+}
+
+// typeCorrectionStats returns the counters, most frequent first.
+func typeCorrectionStats() []TypeCorrection {
+	typeCorrections.Lock()
+	defer typeCorrections.Unlock()
+	stats := make([]TypeCorrection, 0, len(typeCorrections.counts))
+	for k, n := range typeCorrections.counts {
+		stats = append(stats, TypeCorrection{From: k.from, To: k.to, KeyLabel: k.label, Count: n})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Count != stats[j].Count {
+			return stats[i].Count > stats[j].Count
+		}
+		a, b := stats[i], stats[j]
+		return a.KeyLabel+a.From+a.To < b.KeyLabel+b.From+b.To
+	})
+	return stats
+}
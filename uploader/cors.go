@@ -0,0 +1,59 @@
+package uploader
+
+import (
+	"net/http"
+	"path"
+)
+
+// allowedOrigins are the browser origins CORS_ALLOWED_ORIGINS lets call the
+// API. Entries are exact origins, * for any origin, or patterns such as
+// https://*.example.com, where * matches within the host.
+var allowedOrigins []string
+
+func initCORS() {
+	allowedOrigins = envList("CORS_ALLOWED_ORIGINS")
+	for _, origin := range allowedOrigins {
+		if _, err := path.Match(origin, ""); err != nil {
+			fatalf("Invalid CORS_ALLOWED_ORIGINS: %q is not a valid pattern", origin)
+		}
+	}
+}
+
+// corsMiddleware wraps the whole mux, so every route, including ones only
+// registered by optional features, answers preflights the same way.
+// Preflights are answered here, before rate limits and API key checks,
+// since browsers never send credentials with them.
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(allowedOrigins) > 0 {
+			w.Header().Add("Vary", "Origin")
+		}
+		if origin != "" && isOriginAllowed(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key, X-Filename, X-Metadata, X-Progress-Token, X-Logical-Id, X-Upload-Prefix, X-Request-ID")
+			w.Header().Set("Access-Control-Max-Age", "3600")
+			w.Header().Set("Access-Control-Expose-Headers", "Location, X-Progress-Token, X-Request-ID, Retry-After")
+		}
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isOriginAllowed(origin string) bool {
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		if ok, _ := path.Match(allowed, origin); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package uploader
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsOriginAllowed(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{[]string{"https://app.example.com"}, "https://app.example.com", true},
+		{[]string{"https://app.example.com"}, "http://app.example.com", false},
+		{[]string{"https://app.example.com"}, "https://app.example.com:8443", false},
+		{[]string{"https://*.example.com"}, "https://a.example.com", true},
+		{[]string{"https://*.example.com"}, "https://a.b.example.com", true},
+		{[]string{"https://*.example.com"}, "https://example.com", false},
+		{[]string{"https://*.example.com"}, "https://evil-example.com", false},
+		{[]string{"https://*.example.com"}, "https://a.example.com.evil.com", false},
+		{[]string{"https://*.example.com"}, "https://evil.com/.example.com", false},
+		{[]string{"https://*.example.com"}, "http://a.example.com", false},
+		{[]string{"https://*.example.com", "https://other.org"}, "https://other.org", true},
+		{[]string{"*"}, "https://anything.test", true},
+		{nil, "https://app.example.com", false},
+	}
+	for _, tc := range tests {
+		allowedOrigins = tc.allowed
+		if got := isOriginAllowed(tc.origin); got != tc.want {
+			t.Errorf("%q against %v: allowed %v, want %v", tc.origin, tc.allowed, got, tc.want)
+		}
+	}
+	allowedOrigins = nil
+}
+
+func TestServerCORSPreflightOnAnyRoute(t *testing.T) {
+	srv, _ := newTestServer(t, Config{Settings: map[string]string{"CORS_ALLOWED_ORIGINS": "https://*.example.com"}})
+
+	for _, tc := range []struct {
+		target, origin string
+		allowed        bool
+	}{
+		{"/upload", "https://app.example.com", true},
+		{"/images", "https://app.example.com", true},
+		{"/delete", "https://app.example.com", true},
+		{"/no-such-route", "https://app.example.com", true},
+		{"/images", "https://evil-example.com", false},
+		{"/images", "https://a.example.com.evil.com", false},
+	} {
+		// No X-API-Key: browsers never send it on a preflight.
+		req := httptest.NewRequest(http.MethodOptions, tc.target, nil)
+		req.Header.Set("Origin", tc.origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("OPTIONS %s from %s: status %d, want 204", tc.target, tc.origin, rec.Code)
+		}
+		got := rec.Header().Get("Access-Control-Allow-Origin")
+		if tc.allowed && got != tc.origin {
+			t.Errorf("OPTIONS %s from %s: Access-Control-Allow-Origin %q, want the origin", tc.target, tc.origin, got)
+		}
+		if !tc.allowed && got != "" {
+			t.Errorf("OPTIONS %s from %s: Access-Control-Allow-Origin %q, want none", tc.target, tc.origin, got)
+		}
+		if vary := rec.Header().Values("Vary"); len(vary) == 0 {
+			t.Errorf("OPTIONS %s: no Vary header", tc.target)
+		}
+	}
+}
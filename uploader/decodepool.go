@@ -0,0 +1,35 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"time"
+)
+
+var errDecodeBusy = errors.New("timed out waiting for a decode slot")
+
+// decodeSlots bounds CPU-bound image work separately from I/O-bound uploads,
+// so a burst of decodes can't starve the goroutines streaming to R2.
+var decodeSlots = make(chan struct{}, runtime.GOMAXPROCS(0))
+var decodeQueueTimeout = 5 * time.Second
+
+func initDecodePool() {
+	decodeSlots = make(chan struct{}, envInt("DECODE_CONCURRENCY", runtime.GOMAXPROCS(0)))
+	decodeQueueTimeout = envDuration("DECODE_QUEUE_TIMEOUT", decodeQueueTimeout)
+}
+
+func withDecodeSlot(ctx context.Context, fn func() error) error {
+	timer := time.NewTimer(decodeQueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case decodeSlots <- struct{}{}:
+	case <-timer.C:
+		return errDecodeBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-decodeSlots }()
+	return fn()
+}
@@ -0,0 +1,86 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"log"
+	"path/filepath"
+	"strconv"
+)
+
+// dedupeDefault is DEDUPE: whether uploads are deduplicated when the request
+// doesn't say.
+var dedupeDefault bool
+
+// uniquenessScope is UNIQUENESS_SCOPE: the prefix content-derived keys live
+// under, and so how far deduplication and the hash strategies look for an
+// identical file.
+var uniquenessScope = "prefix"
+
+func initDedupe() {
+	dedupeDefault = envBool("DEDUPE")
+	switch scope := getenv("UNIQUENESS_SCOPE"); scope {
+	case "":
+	case "prefix", "tenant", "bucket":
+		uniquenessScope = scope
+	default:
+		fatal("Invalid UNIQUENESS_SCOPE: must be prefix, tenant or bucket")
+	}
+}
+
+// contentPrefix is where label keeps a file keyed by its content, given the
+// prefix it uploads to: that prefix, folder included, for the prefix scope,
+// the label's upload prefix for tenant, and the shared upload prefix for
+// bucket.
+func contentPrefix(label, prefix string) string {
+	switch uniquenessScope {
+	case "tenant":
+		return uploadPrefixFor(label)
+	case "bucket":
+		return uploadPrefix
+	}
+	return prefix
+}
+
+// parseDedupe reads a dedupe parameter, defaulting to DEDUPE.
+func parseDedupe(v string) (bool, error) {
+	if v == "" {
+		return dedupeDefault, nil
+	}
+	dedupe, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errors.New("dedupe must be true or false")
+	}
+	return dedupe, nil
+}
+
+// strategyPrefix is the prefix for a KEY_STRATEGY key. The hash and
+// idempotent strategies overwrite an identical file, so they follow
+// UNIQUENESS_SCOPE like deduplication does.
+func strategyPrefix(label, prefix string) string {
+	if usesContentHash() {
+		return contentPrefix(label, prefix)
+	}
+	return prefix
+}
+
+// dedupeFileName keys a file by its content whatever KEY_STRATEGY says, so
+// identical files within the UNIQUENESS_SCOPE land on one key.
+func dedupeFileName(label, prefix string, in KeyInput) string {
+	return shardedKey(contentPrefix(label, prefix), in.SHA256+filepath.Ext(in.Original))
+}
+
+// existingURL returns the URL of key when some backend already has it. A
+// failed lookup counts as missing, so the file is uploaded as usual.
+func existingURL(ctx context.Context, key string) (string, bool) {
+	url, err := routeRead(func(store Storage) (string, error) {
+		if _, err := store.Head(ctx, key); err != nil {
+			return "", err
+		}
+		return store.PublicURL(ctx, key)
+	})
+	if err != nil && !isNotFound(err) {
+		log.Println("Duplicate check failed for", key+":", err)
+	}
+	return url, err == nil
+}
@@ -0,0 +1,254 @@
+package uploader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// DeleteObjects takes at most 1000 keys per call.
+const deleteBatchSize = 1000
+
+var maxDeleteKeys = 100
+var deleteConcurrency = 4
+
+func initDelete() {
+	if maxDeleteKeys = envInt("MAX_DELETE_KEYS", maxDeleteKeys); maxDeleteKeys > 10000 {
+		fatal("Invalid MAX_DELETE_KEYS: must be between 1 and 10000")
+	}
+	deleteConcurrency = envInt("DELETE_CONCURRENCY", deleteConcurrency)
+}
+
+type DeleteRequest struct {
+	URLs []string `json:"urls"`
+}
+
+// keyFromURL recovers the object key from a public URL returned by an
+// upload, on R2 or on the fallback backend.
+func keyFromURL(raw string) (string, bool) {
+	raw, _, _ = strings.Cut(raw, "?")
+	raw, _, _ = strings.Cut(raw, "#")
+	for _, base := range []string{publicURL, fallbackPublicURL()} {
+		if base == "" || !strings.HasPrefix(raw, base+"/") {
+			continue
+		}
+		key, err := url.PathUnescape(strings.TrimPrefix(raw, base+"/"))
+		return key, err == nil
+	}
+	return "", false
+}
+
+func fallbackPublicURL() string {
+	if fallback == nil {
+		return ""
+	}
+	return fallback.publicURL
+}
+
+// requestedKeys reads the objects a delete or restore names, as a key
+// parameter or a JSON list of URLs. items are what the caller sent (reported
+// back as-is); keys are the matching object keys. On a bad request the error
+// has been sent and ok is false.
+func requestedKeys(w http.ResponseWriter, r *http.Request) (items, keys []string, ok bool) {
+	prefix := uploadPrefixFor(keyLabel(r))
+	if key := r.URL.Query().Get("key"); key != "" {
+		items, keys = []string{key}, []string{key}
+	} else {
+		var req DeleteRequest
+		limit := max(1<<20, int64(maxDeleteKeys)<<11) // ~2KB per URL
+		if err := json.NewDecoder(io.LimitReader(r.Body, limit)).Decode(&req); err != nil {
+			sendJSONMulti(w, 400, nil, nil, "Invalid JSON body")
+			return nil, nil, false
+		}
+		if len(req.URLs) == 0 {
+			sendJSONMulti(w, 400, nil, nil, "At least 1 URL or a key parameter required")
+			return nil, nil, false
+		}
+		if len(req.URLs) > maxDeleteKeys {
+			sendJSONMulti(w, 400, nil, nil, fmt.Sprintf("Maximum %d URLs allowed", maxDeleteKeys))
+			return nil, nil, false
+		}
+		for _, u := range req.URLs {
+			key, ok := keyFromURL(u)
+			if !ok {
+				sendJSONMulti(w, 400, nil, []string{u + ": Not a URL from this service"}, "URLs must start with R2_PUBLIC_URL")
+				return nil, nil, false
+			}
+			items, keys = append(items, u), append(keys, key)
+		}
+	}
+	for i, key := range keys {
+		if !ownsKey(keyLabel(r), key) {
+			sendJSONMulti(w, 400, nil, []string{items[i] + ": Invalid key"}, "Keys must be under "+prefix)
+			return nil, nil, false
+		}
+	}
+	return items, keys, true
+}
+
+func deleteHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodDelete) || !allowOperation(w, r, opDelete) {
+		return
+	}
+
+	items, keys, ok := requestedKeys(w, r)
+	if !ok {
+		return
+	}
+
+	errs := deleteKeys(r.Context(), keyLabel(r), keys)
+
+	// A key that didn't exist is gone all the same, so it counts as deleted
+	// (as in S3) and is also listed in not_found.
+	var deleted, notFound, failed []string
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			deleted = append(deleted, items[i])
+		case errors.Is(err, errNoObject):
+			deleted = append(deleted, items[i])
+			notFound = append(notFound, items[i])
+		case errors.Is(err, context.DeadlineExceeded):
+			failed = append(failed, items[i]+": Delete timed out")
+		default:
+			log.Println("Delete failed for", keys[i]+":", err)
+			failed = append(failed, items[i]+": Delete failed")
+		}
+	}
+
+	resp := ApiResponse{URLs: deleted, Failed: failed, NotFound: notFound}
+	switch {
+	case len(deleted) == 0:
+		resp.Status, resp.Message = 502, "All deletes failed"
+	case len(failed) > 0:
+		resp.Status, resp.Message = 207, fmt.Sprintf("%d of %d objects deleted", len(deleted), len(keys))
+	default:
+		resp.Status, resp.Message = 200, fmt.Sprintf("%d object(s) deleted", len(deleted))
+	}
+	sendResponse(w, resp)
+}
+
+// deleteKeys is what a delete request does to its keys: move them to the
+// trash under SOFT_DELETE, remove them otherwise.
+func deleteKeys(ctx context.Context, label string, keys []string) []error {
+	if softDelete {
+		return trashObjects(ctx, label, keys)
+	}
+	return purgeObjects(ctx, label, keys)
+}
+
+// purgeObjects deletes keys for good. Every key is first looked up, in
+// parallel, to tell missing ones apart and to size them for the quota; the
+// ones found are then removed with DeleteObjects, deleteBatchSize keys per
+// call. errs[i] is nil, errNoObject or the failure for keys[i].
+func purgeObjects(ctx context.Context, label string, keys []string) []error {
+	errs := make([]error, len(keys))
+	sizes := make([]int64, len(keys))
+	runBounded(len(keys), deleteConcurrency, func(i int) {
+		headCtx, cancel := withOptionalTimeout(ctx, deleteTimeout)
+		defer cancel()
+		head, err := routeRead(func(store Storage) (StoredObject, error) {
+			return store.Head(headCtx, keys[i])
+		})
+		switch {
+		case isNotFound(err):
+			errs[i] = errNoObject
+		case err != nil:
+			errs[i] = err
+		default:
+			sizes[i] = head.Size
+		}
+	})
+
+	var found []int
+	for i, err := range errs {
+		if err == nil {
+			found = append(found, i)
+		}
+	}
+	chunks := (len(found) + deleteBatchSize - 1) / deleteBatchSize
+	runBounded(chunks, deleteConcurrency, func(c int) {
+		chunk := found[c*deleteBatchSize : min((c+1)*deleteBatchSize, len(found))]
+		batchCtx, cancel := withOptionalTimeout(ctx, deleteTimeout)
+		defer cancel()
+		// With a fallback the object may be on either store, so both are
+		// cleared, as purgeObject does.
+		deleteBatch(batchCtx, storage, keys, chunk, errs)
+		if fallback != nil {
+			deleteBatch(batchCtx, fallback.Storage, keys, chunk, errs)
+		}
+	})
+
+	var released int64
+	counted := map[string]bool{}
+	for i, err := range errs {
+		if err == nil && !counted[keys[i]] {
+			released += sizes[i]
+			counted[keys[i]] = true
+		}
+	}
+	releaseQuota(label, released)
+	return errs
+}
+
+// deleteBatch removes keys[i] for every i in chunk with one DeleteBatch
+// call, recording per-key failures in errs.
+func deleteBatch(ctx context.Context, store Storage, keys []string, chunk []int, errs []error) {
+	batch := make([]string, len(chunk))
+	for n, i := range chunk {
+		batch[n] = keys[i]
+	}
+	for n, err := range store.DeleteBatch(ctx, batch) {
+		if err != nil {
+			errs[chunk[n]] = err
+		}
+	}
+}
+
+// runBounded calls fn for 0..n-1 with at most limit calls in flight.
+func runBounded(n, limit int, fn func(i int)) {
+	slots := make(chan struct{}, max(limit, 1))
+	var wg sync.WaitGroup
+	for i := range n {
+		slots <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-slots }()
+			fn(i)
+		})
+	}
+	wg.Wait()
+}
+
+// purgeObject removes key from R2 and, since a failed-over object may live
+// there instead, from the fallback too. Deleting a missing key succeeds, as
+// in S3. Under a quota the object is sized first so its bytes are released.
+func purgeObject(ctx context.Context, label, key string) error {
+	var size int64
+	if hasQuota(label) {
+		head, err := routeRead(func(store Storage) (StoredObject, error) {
+			return store.Head(ctx, key)
+		})
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+		size = head.Size
+	}
+
+	if err := storage.Delete(ctx, key); err != nil {
+		return err
+	}
+	if fallback != nil {
+		if err := fallback.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	releaseQuota(label, size)
+	return nil
+}
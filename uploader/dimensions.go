@@ -0,0 +1,85 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// dimensionLimit caps width and height in pixels; 0 leaves a side unlimited.
+type dimensionLimit struct {
+	width, height int
+}
+
+var maxDimensions dimensionLimit
+var typeDimensions = map[string]dimensionLimit{}
+
+type dimensionError struct {
+	side  string
+	value int
+	max   int
+	scope string
+}
+
+func (e *dimensionError) Error() string {
+	return fmt.Sprintf("%s %dpx exceeds the %s limit of %dpx", e.side, e.value, e.scope, e.max)
+}
+
+func initDimensions() {
+	maxDimensions = dimensionLimit{
+		width:  envIntMin("MAX_IMAGE_WIDTH", 0, 0),
+		height: envIntMin("MAX_IMAGE_HEIGHT", 0, 0),
+	}
+	for _, entry := range envList("MAX_DIMENSIONS") {
+		contentType, size, _ := strings.Cut(entry, "=")
+		w, h, ok := strings.Cut(size, "x")
+		width, errW := strconv.Atoi(w)
+		height, errH := strconv.Atoi(h)
+		if _, known := sniffedExtensions[contentType]; !known || !ok || errW != nil || errH != nil || width < 1 || height < 1 {
+			fatalf("Invalid MAX_DIMENSIONS entry %q: must look like image/png=1024x1024", entry)
+		}
+		typeDimensions[contentType] = dimensionLimit{width: width, height: height}
+	}
+}
+
+func dimensionLimitsEnabled() bool {
+	return maxDimensions != (dimensionLimit{}) || len(typeDimensions) > 0
+}
+
+// needsHeaderCheck reports whether an upload of contentType gets the
+// image.DecodeConfig pass. Matching magic bytes aren't enough on their own, so
+// every type with a decoder gets it. AVIF has none here, so it is only parsed
+// when dimension limits need it, and then it fails.
+func needsHeaderCheck(contentType string) bool {
+	return contentType != "image/avif" || dimensionLimitsEnabled()
+}
+
+// checkDimensions reads the image header and applies the limit for the
+// detected type, or the global limit when that type has none. It returns the
+// header and format name for the response.
+func checkDimensions(ctx context.Context, r io.Reader) (image.Config, string, error) {
+	var cfg image.Config
+	var format string
+	err := withDecodeSlot(ctx, func() (err error) {
+		cfg, format, err = image.DecodeConfig(r)
+		return err
+	})
+	if err != nil {
+		return cfg, "", err
+	}
+
+	limit, scope := maxDimensions, "global"
+	if typed, ok := typeDimensions["image/"+format]; ok {
+		limit, scope = typed, "image/"+format
+	}
+	if limit.width > 0 && cfg.Width > limit.width {
+		return cfg, format, &dimensionError{side: "width", value: cfg.Width, max: limit.width, scope: scope}
+	}
+	if limit.height > 0 && cfg.Height > limit.height {
+		return cfg, format, &dimensionError{side: "height", value: cfg.Height, max: limit.height, scope: scope}
+	}
+	return cfg, format, nil
+}
@@ -0,0 +1,67 @@
+package uploader
+
+import (
+	"io"
+	"strconv"
+)
+
+var entropyCheck bool
+var entropyMaxChiSquare = 350.0
+var entropyMinSize int64 = 64 << 10
+
+func initEntropyCheck() {
+	entropyCheck = envBool("ENTROPY_CHECK")
+	if v := getenv("ENTROPY_MAX_CHI_SQUARE"); v != "" {
+		t, err := strconv.ParseFloat(v, 64)
+		if err != nil || t <= 0 {
+			fatal("Invalid ENTROPY_MAX_CHI_SQUARE: must be a positive number")
+		}
+		entropyMaxChiSquare = t
+	}
+	entropyMinSize = int64(envInt("ENTROPY_MIN_SIZE", int(entropyMinSize)))
+}
+
+// byteChiSquare measures how far r's byte histogram is from perfectly
+// uniform. Unlike raw Shannon entropy it doesn't drift with file size:
+// random or encrypted data scores around 255 whatever its length, while
+// real image data, compressed or not, scores in the thousands.
+func byteChiSquare(r io.Reader) (float64, int64, error) {
+	var counts [256]int64
+	var total int64
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := r.Read(buf)
+		for _, b := range buf[:n] {
+			counts[b]++
+		}
+		total += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, total, err
+		}
+	}
+	if total == 0 {
+		return 0, 0, nil
+	}
+
+	expected := float64(total) / 256
+	chi := 0.0
+	for _, c := range counts {
+		d := float64(c) - expected
+		chi += d * d / expected
+	}
+	return chi, total, nil
+}
+
+// looksEncrypted flags content that is statistically indistinguishable from
+// random bytes. JPEG/PNG/WebP data is compressed but keeps structure
+// (markers, headers, entropy-coder bias) that pushes it well off uniform.
+func looksEncrypted(r io.Reader) (bool, error) {
+	chi, size, err := byteChiSquare(r)
+	if err != nil {
+		return false, err
+	}
+	return size >= entropyMinSize && chi <= entropyMaxChiSquare, nil
+}
@@ -0,0 +1,263 @@
+package uploader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"strings"
+	"time"
+)
+
+var extractMetadata bool
+
+// ImageMetadata is the curated subset of EXIF reported per file. Fields the
+// image doesn't carry are omitted.
+type ImageMetadata struct {
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	TakenAt     string `json:"taken_at,omitempty"`
+	CameraMake  string `json:"camera_make,omitempty"`
+	CameraModel string `json:"camera_model,omitempty"`
+	LensModel   string `json:"lens_model,omitempty"`
+	// Orientation is the EXIF orientation, 1-8; 1 is upright and is left
+	// out like a missing tag.
+	Orientation int `json:"orientation,omitempty"`
+	// tagged is set when the EXIF block has an orientation tag at all,
+	// upright included.
+	tagged bool
+}
+
+// Largest EXIF block read from PNG and WebP; JPEG segments are capped at
+// 64KB by the format itself.
+const maxExifSize = 1 << 20
+
+const (
+	tagMake        = 0x010f
+	tagModel       = 0x0110
+	tagOrientation = 0x0112
+	tagExifIFD     = 0x8769
+	tagDateTaken   = 0x9003
+	tagOffsetTaken = 0x9011
+	tagLensModel   = 0xa434
+)
+
+var errNoExif = errors.New("no EXIF data")
+
+// readImageMetadata reports the dimensions from the image header and
+// whatever EXIF fields are present. It only reads the headers and never
+// fails the upload: a file without EXIF just yields the dimensions.
+func readImageMetadata(ctx context.Context, r io.ReadSeeker) *ImageMetadata {
+	var meta ImageMetadata
+	var cfg image.Config
+	var format string
+	err := withDecodeSlot(ctx, func() (err error) {
+		cfg, format, err = image.DecodeConfig(r)
+		return err
+	})
+	if err != nil {
+		return nil
+	}
+	meta.Width, meta.Height = cfg.Width, cfg.Height
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return &meta
+	}
+	var tiff []byte
+	br := bufio.NewReader(r)
+	switch format {
+	case "jpeg":
+		tiff, err = jpegExif(br)
+	case "png":
+		tiff, err = pngExif(br)
+	case "webp":
+		tiff, err = webpExif(br)
+	default:
+		err = errNoExif
+	}
+	if err == nil {
+		parseExif(tiff, &meta)
+	}
+	return &meta
+}
+
+// jpegExif walks the markers up to the start of the image data looking for
+// an APP1 segment with the Exif header.
+func jpegExif(r *bufio.Reader) ([]byte, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return nil, errNoExif
+	}
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil || marker[0] != 0xff {
+			return nil, errNoExif
+		}
+		if marker[1] == 0xda { // start of scan
+			return nil, errNoExif
+		}
+		size := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if size < 0 {
+			return nil, errNoExif
+		}
+		if marker[1] != 0xe1 {
+			if _, err := r.Discard(size); err != nil {
+				return nil, errNoExif
+			}
+			continue
+		}
+		segment := make([]byte, size)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, errNoExif
+		}
+		if tiff, ok := bytes.CutPrefix(segment, []byte("Exif\x00\x00")); ok {
+			return tiff, nil
+		}
+	}
+}
+
+// pngExif looks for an eXIf chunk ahead of the image data, where encoders
+// are required to put it.
+func pngExif(r *bufio.Reader) ([]byte, error) {
+	if _, err := r.Discard(8); err != nil {
+		return nil, errNoExif
+	}
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, errNoExif
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		switch string(header[4:]) {
+		case "IDAT", "IEND":
+			return nil, errNoExif
+		case "eXIf":
+			if size > maxExifSize {
+				return nil, errNoExif
+			}
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, errNoExif
+			}
+			return data, nil
+		}
+		if _, err := io.CopyN(io.Discard, r, size+4); err != nil { // data and CRC
+			return nil, errNoExif
+		}
+	}
+}
+
+// webpExif scans the RIFF chunks for EXIF, which extended WebP files store
+// after the image data.
+func webpExif(r *bufio.Reader) ([]byte, error) {
+	if _, err := r.Discard(12); err != nil {
+		return nil, errNoExif
+	}
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, errNoExif
+		}
+		size := int64(binary.LittleEndian.Uint32(header[4:]))
+		padded := size + size&1
+		if string(header[:4]) != "EXIF" {
+			if _, err := io.CopyN(io.Discard, r, padded); err != nil {
+				return nil, errNoExif
+			}
+			continue
+		}
+		if size > maxExifSize {
+			return nil, errNoExif
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, errNoExif
+		}
+		// Some encoders keep the JPEG-style header in the chunk.
+		data, _ = bytes.CutPrefix(data, []byte("Exif\x00\x00"))
+		return data, nil
+	}
+}
+
+// parseExif reads the wanted tags from IFD0 and the Exif sub-IFD of a TIFF
+// block. Malformed entries are skipped rather than reported.
+func parseExif(tiff []byte, meta *ImageMetadata) {
+	if len(tiff) < 8 {
+		return
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return
+	}
+
+	tags := map[uint16]string{}
+	var exifOffset uint32
+	var orientation uint16
+	readIFD := func(offset uint32) {
+		if int64(offset)+2 > int64(len(tiff)) {
+			return
+		}
+		count := int(order.Uint16(tiff[offset:]))
+		for i := 0; i < count; i++ {
+			entry := int64(offset) + 2 + int64(i)*12
+			if entry+12 > int64(len(tiff)) {
+				return
+			}
+			tag := order.Uint16(tiff[entry:])
+			typ := order.Uint16(tiff[entry+2:])
+			n := order.Uint32(tiff[entry+4:])
+			value := tiff[entry+8 : entry+12]
+			switch {
+			case tag == tagExifIFD && typ == 4: // LONG
+				exifOffset = order.Uint32(value)
+			case tag == tagOrientation && typ == 3 && n == 1: // SHORT
+				orientation = order.Uint16(value)
+			case typ == 2: // ASCII
+				if n > 4 {
+					start := int64(order.Uint32(value))
+					if start+int64(n) > int64(len(tiff)) {
+						continue
+					}
+					value = tiff[start : start+int64(n)]
+				} else {
+					value = value[:n]
+				}
+				tags[tag] = strings.TrimSpace(strings.TrimRight(string(value), "\x00"))
+			}
+		}
+	}
+	readIFD(order.Uint32(tiff[4:]))
+	if exifOffset != 0 {
+		readIFD(exifOffset)
+	}
+
+	meta.CameraMake = tags[tagMake]
+	meta.CameraModel = tags[tagModel]
+	meta.LensModel = tags[tagLensModel]
+	meta.TakenAt = exifTime(tags[tagDateTaken], tags[tagOffsetTaken])
+	if orientation > 1 && orientation <= 8 {
+		meta.Orientation = int(orientation)
+	}
+	meta.tagged = orientation >= 1 && orientation <= 8
+}
+
+// exifTime turns EXIF's "2006:01:02 15:04:05" into RFC 3339. Without an
+// offset tag the camera's time zone is unknown, so the zone is left off.
+func exifTime(value, offset string) string {
+	t, err := time.Parse("2006:01:02 15:04:05", value)
+	if err != nil {
+		return ""
+	}
+	if zone, err := time.Parse("-07:00", offset); err == nil {
+		return t.Format("2006-01-02T15:04:05") + zone.Format("Z07:00")
+	}
+	return t.Format("2006-01-02T15:04:05")
+}
@@ -0,0 +1,114 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// fallbackBackend is a secondary S3-compatible store that uploads fail over
+// to while R2 is unavailable. Objects keep the same key on either backend.
+type fallbackBackend struct {
+	Storage
+	publicURL string
+}
+
+var fallback *fallbackBackend
+
+func initFallback() {
+	endpoint := getenv("FALLBACK_BACKEND")
+	if endpoint == "" {
+		return
+	}
+	if u, err := url.Parse(endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+		fatal("Invalid FALLBACK_BACKEND: must be an endpoint URL such as https://s3.us-east-1.amazonaws.com")
+	}
+
+	bucket := getenv("FALLBACK_BUCKET_NAME")
+	accessKey := getenv("FALLBACK_ACCESS_KEY")
+	secretKey := getenv("FALLBACK_SECRET_KEY")
+	if bucket == "" || accessKey == "" || secretKey == "" {
+		fatal("Missing required environment variables for FALLBACK_BACKEND: FALLBACK_BUCKET_NAME, FALLBACK_ACCESS_KEY, FALLBACK_SECRET_KEY")
+	}
+	region := getenv("FALLBACK_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	publicBase := strings.TrimSuffix(getenv("FALLBACK_PUBLIC_URL"), "/")
+	if publicBase == "" && (presignExpiry < time.Second || presignExpiry > 7*24*time.Hour) {
+		fatal("Invalid PRESIGN_EXPIRY: must be between 1s and 168h when FALLBACK_PUBLIC_URL is not set")
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background(),
+		config.WithRegion(region),
+		config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(accessKey, secretKey, ""),
+		),
+		config.WithRetryer(newRetryer),
+	)
+	if err != nil {
+		fatal("Failed to load fallback backend config:", err)
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.BaseEndpoint = aws.String(endpoint)
+		o.UsePathStyle = envBool("FALLBACK_PATH_STYLE")
+	})
+	fallback = &fallbackBackend{Storage: newS3Storage(client, bucket, publicBase), publicURL: publicBase}
+	log.Println("Fallback backend enabled:", endpoint)
+}
+
+// canFailOver reports whether a failed R2 write may be replayed against the
+// fallback. A tripped breaker never read the body; otherwise the body has to
+// rewind, and errors caused by the client or the deadline are not retried.
+func canFailOver(err error, body io.Reader) bool {
+	if fallback == nil {
+		return false
+	}
+	if errors.Is(err, errCircuitOpen) {
+		return true
+	}
+	var maxErr *http.MaxBytesError
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.As(err, &maxErr) {
+		return false
+	}
+	seeker, ok := body.(io.Seeker)
+	if !ok {
+		return false
+	}
+	_, err = seeker.Seek(0, io.SeekStart)
+	return err == nil
+}
+
+func (f *fallbackBackend) upload(ctx context.Context, body io.Reader, size int64, filename string, opts UploadOptions) (string, error) {
+	if err := f.Put(ctx, filename, throttle(ctx, body), size, opts); err != nil {
+		logStorageError("Fallback PutObject", filename, err)
+		return "", err
+	}
+	return f.PublicURL(ctx, filename)
+}
+
+// routeRead runs read against R2 and, if that fails while a fallback is
+// configured, against the fallback, since objects written during an outage
+// only exist there. R2's error wins unless R2 reported the key missing.
+func routeRead[T any](read func(store Storage) (T, error)) (T, error) {
+	out, err := read(storage)
+	if err == nil || fallback == nil {
+		return out, err
+	}
+	fbOut, fbErr := read(fallback.Storage)
+	if fbErr == nil || isNotFound(err) {
+		return fbOut, fbErr
+	}
+	return out, err
+}
@@ -0,0 +1,96 @@
+package uploader
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+var uploadFields = []string{"images"}
+var uploadFieldPolicy = "merge"
+
+func initUploadFields() {
+	if fields := envList("UPLOAD_FIELDS"); len(fields) > 0 {
+		uploadFields = fields
+	}
+	switch policy := getenv("UPLOAD_FIELD_POLICY"); policy {
+	case "":
+	case "merge", "reject":
+		uploadFieldPolicy = policy
+	default:
+		fatal("Invalid UPLOAD_FIELD_POLICY: must be merge or reject")
+	}
+}
+
+// collectUploadFiles returns the files from every accepted field, in
+// UPLOAD_FIELDS order. Files under any other field name are an error rather
+// than being silently dropped.
+func collectUploadFiles(form *uploadForm) ([]*formFile, error) {
+	accepted := map[string]bool{}
+	for _, field := range uploadFields {
+		accepted[field] = true
+	}
+	var unknown []string
+	for field := range form.File {
+		if !accepted[field] {
+			unknown = append(unknown, field)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("Unexpected file field %s; send files as %s", strings.Join(unknown, ", "), strings.Join(uploadFields, " or "))
+	}
+
+	var used []string
+	var files []*formFile
+	for _, field := range uploadFields {
+		if len(form.File[field]) > 0 {
+			used = append(used, field)
+			files = append(files, form.File[field]...)
+		}
+	}
+	if len(used) < 2 {
+		return files, nil
+	}
+	if uploadFieldPolicy == "reject" {
+		return nil, fmt.Errorf("Files sent in more than one field (%s); use only one", strings.Join(used, ", "))
+	}
+	return dedupeFiles(files), nil
+}
+
+// dedupeFiles drops files whose content matches an earlier file, which is
+// what a client sending the same files under two field names produces.
+func dedupeFiles(files []*formFile) []*formFile {
+	seen := map[[sha256.Size]byte]bool{}
+	var unique []*formFile
+	for _, fh := range files {
+		sum, err := hashPart(fh)
+		if err != nil {
+			// Keep it so the upload loop reports the open failure.
+			unique = append(unique, fh)
+			continue
+		}
+		if !seen[sum] {
+			seen[sum] = true
+			unique = append(unique, fh)
+		}
+	}
+	return unique
+}
+
+func hashPart(fh *formFile) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	file, err := fh.Open()
+	if err != nil {
+		return sum, err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
@@ -0,0 +1,93 @@
+package uploader
+
+import (
+	"fmt"
+	"log"
+	"math/bits"
+	"strings"
+	"sync/atomic"
+)
+
+// sizeHistogram counts uploaded file sizes in power-of-two buckets: bucket i
+// holds sizes in [2^(i-1), 2^i), bucket 0 holds empty files.
+type sizeHistogram struct {
+	buckets [65]atomic.Int64
+	total   atomic.Int64
+}
+
+var uploadSizes sizeHistogram
+
+func (h *sizeHistogram) record(size int64) {
+	if size < 0 {
+		return
+	}
+	h.buckets[bits.Len64(uint64(size))].Add(1)
+	h.total.Add(size)
+}
+
+// percentile returns the exclusive upper bound of the bucket holding the p-th
+// percentile, so it is accurate to within a factor of two.
+func (h *sizeHistogram) percentile(counts []int64, n int64, p float64) int64 {
+	rank := int64(float64(n)*p + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, c := range counts {
+		seen += c
+		if seen >= rank {
+			return bucketUpper(i)
+		}
+	}
+	return bucketUpper(len(counts) - 1)
+}
+
+func bucketUpper(i int) int64 {
+	if i >= 63 {
+		return 1<<63 - 1
+	}
+	return 1 << i
+}
+
+func (h *sizeHistogram) logSummary() {
+	counts := make([]int64, len(h.buckets))
+	var n int64
+	for i := range h.buckets {
+		counts[i] = h.buckets[i].Load()
+		n += counts[i]
+	}
+	if n == 0 {
+		log.Println("Upload sizes: no uploads")
+		return
+	}
+
+	log.Printf("Upload sizes: %d file(s), %s total, p50 < %s, p90 < %s, p99 < %s",
+		n, formatBytes(h.total.Load()),
+		formatBytes(h.percentile(counts, n, 0.50)),
+		formatBytes(h.percentile(counts, n, 0.90)),
+		formatBytes(h.percentile(counts, n, 0.99)))
+	var rows []string
+	for i, c := range counts {
+		if c == 0 {
+			continue
+		}
+		if i == 0 {
+			rows = append(rows, fmt.Sprintf("0B: %d", c))
+			continue
+		}
+		rows = append(rows, fmt.Sprintf("%s-%s: %d", formatBytes(1<<(i-1)), formatBytes(bucketUpper(i)), c))
+	}
+	log.Println("Upload sizes by bucket:", strings.Join(rows, ", "))
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,66 @@
+package uploader
+
+import (
+	"context"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+
+	_ "golang.org/x/image/webp"
+)
+
+type ImageFormat struct {
+	ColorModel string
+	HasAlpha   *bool
+	Grayscale  *bool
+	BitDepth   int
+}
+
+// inspectImage reads only the image header via DecodeConfig, so it costs a
+// few hundred bytes of I/O rather than a full decode.
+func inspectImage(ctx context.Context, r io.Reader) (ImageFormat, error) {
+	var cfg image.Config
+	err := withDecodeSlot(ctx, func() (err error) {
+		cfg, _, err = image.DecodeConfig(r)
+		return err
+	})
+	if err != nil {
+		return ImageFormat{}, err
+	}
+	return describeColorModel(cfg.ColorModel), nil
+}
+
+func describeColorModel(model color.Model) ImageFormat {
+	yes, no := true, false
+	switch model {
+	case color.RGBAModel, color.NRGBAModel:
+		return ImageFormat{ColorModel: "rgba", HasAlpha: &yes, Grayscale: &no, BitDepth: 8}
+	case color.RGBA64Model, color.NRGBA64Model:
+		return ImageFormat{ColorModel: "rgba", HasAlpha: &yes, Grayscale: &no, BitDepth: 16}
+	case color.GrayModel:
+		return ImageFormat{ColorModel: "gray", HasAlpha: &no, Grayscale: &yes, BitDepth: 8}
+	case color.Gray16Model:
+		return ImageFormat{ColorModel: "gray", HasAlpha: &no, Grayscale: &yes, BitDepth: 16}
+	case color.YCbCrModel:
+		return ImageFormat{ColorModel: "ycbcr", HasAlpha: &no, Grayscale: &no, BitDepth: 8}
+	case color.NYCbCrAModel:
+		return ImageFormat{ColorModel: "ycbcr", HasAlpha: &yes, Grayscale: &no, BitDepth: 8}
+	case color.CMYKModel:
+		return ImageFormat{ColorModel: "cmyk", HasAlpha: &no, Grayscale: &no, BitDepth: 8}
+	}
+
+	if palette, ok := model.(color.Palette); ok {
+		alpha := false
+		for _, c := range palette {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				alpha = true
+				break
+			}
+		}
+		return ImageFormat{ColorModel: "paletted", HasAlpha: &alpha, BitDepth: 8}
+	}
+	return ImageFormat{}
+}
@@ -0,0 +1,113 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const defaultListLimit = 100
+
+// ListObjectsV2 returns at most 1000 keys per call.
+const maxListLimit = 1000
+
+type ListImagesResponse struct {
+	Status     int          `json:"status"`
+	Message    string       `json:"message"`
+	Objects    []ObjectInfo `json:"objects"`
+	Truncated  bool         `json:"truncated"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// imagesHandler serves GET /images, listing the caller's objects a page at
+// a time, and DELETE /images/{key}, a single-key form of /delete.
+func imagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/images" {
+		if allowMethod(w, r, http.MethodGet) && allowOperation(w, r, opList) {
+			listImages(w, r)
+		}
+		return
+	}
+	if allowMethod(w, r, http.MethodDelete) && allowOperation(w, r, opDelete) {
+		deleteImage(w, r, strings.TrimPrefix(r.URL.Path, "/images/"))
+	}
+}
+
+func listImages(w http.ResponseWriter, r *http.Request) {
+	base := uploadPrefixFor(keyLabel(r))
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		prefix = base
+	}
+	if !strings.HasPrefix(prefix, base) || strings.Contains(prefix, "..") || inOtherTenant(keyLabel(r), prefix) {
+		sendJSON(w, 400, map[string]interface{}{"status": 400, "message": "prefix must be under " + base})
+		return
+	}
+	limit := defaultListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > maxListLimit {
+			sendJSON(w, 400, map[string]interface{}{"status": 400, "message": "limit must be between 1 and " + strconv.Itoa(maxListLimit)})
+			return
+		}
+		limit = parsed
+	}
+
+	page, err := storage.List(r.Context(), prefix, r.URL.Query().Get("cursor"), limit)
+	if err != nil {
+		logStorageError("ListObjects", prefix, err)
+		sendJSON(w, 502, map[string]interface{}{"status": 502, "message": "Failed to list objects"})
+		return
+	}
+
+	// Tenants nested inside a shared prefix are left out, so a page can hold
+	// fewer than limit objects even when more follow.
+	objects := make([]ObjectInfo, 0, len(page.Objects))
+	for _, obj := range page.Objects {
+		if inOtherTenant(keyLabel(r), obj.Key) {
+			continue
+		}
+		info := ObjectInfo{Key: obj.Key, Size: obj.Size}
+		if info.URL, err = objectURL(r.Context(), info.Key); err != nil {
+			log.Println("Failed to build URL for", info.Key+":", err)
+		}
+		objects = append(objects, info)
+	}
+	resp := ListImagesResponse{
+		Status:     200,
+		Objects:    fitResponse(objects),
+		Truncated:  page.NextCursor != "",
+		NextCursor: page.NextCursor,
+	}
+	if len(resp.Objects) < len(objects) {
+		resp.Truncated, resp.NextCursor = true, resp.Objects[len(resp.Objects)-1].Key
+	}
+	resp.Message = strconv.Itoa(len(resp.Objects)) + " object(s)"
+	sendJSON(w, 200, resp)
+}
+
+// deleteImage removes one object, or moves it to the trash under
+// SOFT_DELETE. Unlike /delete, a key that doesn't exist is a 404.
+func deleteImage(w http.ResponseWriter, r *http.Request, key string) {
+	prefix := uploadPrefixFor(keyLabel(r))
+	if !ownsKey(keyLabel(r), key) {
+		sendJSONMulti(w, 400, nil, []string{key + ": Invalid key"}, "Keys must be under "+prefix)
+		return
+	}
+
+	err := deleteKeys(r.Context(), keyLabel(r), []string{key})[0]
+	switch {
+	case err == nil:
+		sendJSONMulti(w, 200, []string{key}, nil, "1 object(s) deleted")
+	case errors.Is(err, errNoObject):
+		sendJSONMulti(w, 404, nil, nil, "Image not found")
+	case errors.Is(err, context.DeadlineExceeded):
+		sendJSONMulti(w, 504, nil, nil, "Delete timed out")
+	default:
+		log.Println("Delete failed for", key+":", err)
+		sendJSONMulti(w, 502, nil, nil, "Delete failed")
+	}
+}
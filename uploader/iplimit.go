@@ -0,0 +1,98 @@
+package uploader
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+var maxRequestsPerIP int
+var trustedProxies []netip.Prefix
+
+// inFlightByIP counts requests currently being served per client IP.
+// Entries are deleted when they drop to zero, so the map only holds IPs
+// with requests open right now.
+var inFlightByIP = struct {
+	sync.Mutex
+	counts map[string]int
+}{counts: map[string]int{}}
+
+func initIPLimit() {
+	maxRequestsPerIP = envIntMin("MAX_CONCURRENT_PER_IP", 0, 0)
+	for _, entry := range envList("TRUSTED_PROXIES") {
+		prefix, err := netip.ParsePrefix(entry)
+		if addr, addrErr := netip.ParseAddr(entry); addrErr == nil {
+			addr = addr.Unmap()
+			prefix, err = netip.PrefixFrom(addr, addr.BitLen()), nil
+		}
+		if err != nil {
+			fatalf("Invalid TRUSTED_PROXIES entry %q: must be an IP or CIDR", entry)
+		}
+		trustedProxies = append(trustedProxies, prefix.Masked())
+	}
+}
+
+func isTrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the peer address, unless the peer is a trusted proxy. In
+// that case X-Forwarded-For is walked from the right, and the first hop that
+// isn't a trusted proxy is the client; hops further left are client-supplied
+// and can't be trusted.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !isTrustedProxy(addr) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		if !isTrustedProxy(hop) {
+			return hop.Unmap().String()
+		}
+	}
+	return host
+}
+
+// ipLimitMiddleware rejects a request with 429 while its client IP already
+// has MAX_CONCURRENT_PER_IP requests in flight.
+func ipLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		inFlightByIP.Lock()
+		if inFlightByIP.counts[ip] >= maxRequestsPerIP {
+			inFlightByIP.Unlock()
+			setRetryAfter(w, time.Second)
+			sendJSONMulti(w, 429, nil, nil, "Too many concurrent requests from this IP")
+			return
+		}
+		inFlightByIP.counts[ip]++
+		inFlightByIP.Unlock()
+
+		defer func() {
+			inFlightByIP.Lock()
+			if inFlightByIP.counts[ip]--; inFlightByIP.counts[ip] <= 0 {
+				delete(inFlightByIP.counts, ip)
+			}
+			inFlightByIP.Unlock()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,149 @@
+package uploader
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// KeyInput is what a strategy may build a key from. SHA256 is only filled in
+// for strategies that ask for it through usesContentHash. LogicalID is the
+// request's logical_id, if any.
+type KeyInput struct {
+	Original  string
+	SHA256    string
+	LogicalID string
+	Now       time.Time
+}
+
+// KeyStrategy names one stored object. Keys come back without the upload
+// prefix or shard directory, which generateFileName adds for every strategy,
+// and must end in the original's extension.
+type KeyStrategy interface {
+	Key(in KeyInput) string
+}
+
+var keyStrategy KeyStrategy = uuidStrategy{}
+
+func initKeyStrategy() {
+	strategy, err := parseKeyStrategy(getenv("KEY_STRATEGY"), getenv("KEY_TEMPLATE"))
+	if err != nil {
+		fatal(err)
+	}
+	keyStrategy = strategy
+}
+
+// parseKeyStrategy picks the strategy for KEY_STRATEGY. Left unset, it is
+// template when KEY_TEMPLATE is set and uuid otherwise, as before strategies
+// were configurable.
+func parseKeyStrategy(name, template string) (KeyStrategy, error) {
+	if name == "" {
+		name = "uuid"
+		if template != "" {
+			name = "template"
+		}
+	}
+	if template != "" && name != "template" {
+		return nil, fmt.Errorf("Invalid KEY_TEMPLATE: only used with KEY_STRATEGY=template, not %s", name)
+	}
+
+	switch name {
+	case "uuid":
+		return uuidStrategy{}, nil
+	case "hash":
+		return hashStrategy{}, nil
+	case "idempotent":
+		return idempotentStrategy{}, nil
+	case "timestamp":
+		return timestampStrategy{}, nil
+	case "template":
+		if template == "" {
+			return nil, errors.New("Missing KEY_TEMPLATE for KEY_STRATEGY=template")
+		}
+		segments, err := parseKeyTemplate(template)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid KEY_TEMPLATE: %w", err)
+		}
+		return templateStrategy{segments: segments}, nil
+	default:
+		return nil, fmt.Errorf("Invalid KEY_STRATEGY: must be uuid, hash, idempotent, template or timestamp")
+	}
+}
+
+// usesContentHash reports whether keys need the file's SHA-256, so the
+// upload path computes it.
+func usesContentHash() bool {
+	switch keyStrategy.(type) {
+	case hashStrategy, idempotentStrategy:
+		return true
+	}
+	return false
+}
+
+// usesLogicalID reports whether keys depend on logical_id, which is then
+// validated even with aliases off.
+func usesLogicalID() bool {
+	_, ok := keyStrategy.(idempotentStrategy)
+	return ok
+}
+
+// uuidStrategy is the default: a random UUID, plus the filename slug when
+// FILENAME_SLUG is on.
+type uuidStrategy struct{}
+
+func (uuidStrategy) Key(in KeyInput) string {
+	ext := filepath.Ext(in.Original)
+	name := uuid.New().String()
+	if slugEnabled {
+		if slug := slugify(strings.TrimSuffix(filepath.Base(in.Original), ext)); slug != "" {
+			name += "-" + slug
+		}
+	}
+	return name + ext
+}
+
+// hashStrategy keys objects by content, so identical uploads share a key.
+type hashStrategy struct{}
+
+func (hashStrategy) Key(in KeyInput) string {
+	return in.SHA256 + filepath.Ext(in.Original)
+}
+
+// idempotentStrategy keys objects by content and logical ID together, so a
+// client that resends a whole request gets the same keys back and the retry
+// overwrites identical bytes. Without a logical ID it is hashStrategy.
+type idempotentStrategy struct{}
+
+func (idempotentStrategy) Key(in KeyInput) string {
+	if in.LogicalID == "" {
+		return hashStrategy{}.Key(in)
+	}
+	sum := sha256.Sum256([]byte(in.LogicalID + "\x00" + in.SHA256))
+	return hex.EncodeToString(sum[:]) + filepath.Ext(in.Original)
+}
+
+// timestampStrategy gives keys that sort by upload time. The random suffix
+// keeps files stored in the same nanosecond apart.
+type timestampStrategy struct{}
+
+func (timestampStrategy) Key(in KeyInput) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return in.Now.UTC().Format("20060102T150405.000000000Z") + "-" + hex.EncodeToString(suffix) + filepath.Ext(in.Original)
+}
+
+// templateStrategy renders KEY_TEMPLATE.
+type templateStrategy struct {
+	segments []keySegment
+}
+
+func (s templateStrategy) Key(in KeyInput) string {
+	return renderKeyTemplate(s.segments, in.Original, in.Now)
+}
@@ -0,0 +1,158 @@
+package uploader
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2024, time.May, 6, 7, 8, 9, 123456789, time.UTC)
+
+func TestParseKeyStrategy(t *testing.T) {
+	tests := []struct {
+		name, template string
+		want           KeyStrategy
+		wantErr        bool
+	}{
+		{name: "", want: uuidStrategy{}},
+		{name: "uuid", want: uuidStrategy{}},
+		{name: "hash", want: hashStrategy{}},
+		{name: "idempotent", want: idempotentStrategy{}},
+		{name: "timestamp", want: timestampStrategy{}},
+		{name: "", template: "{uuid}", want: templateStrategy{}},
+		{name: "template", template: "{now}/{uuid}", want: templateStrategy{}},
+		{name: "template", wantErr: true},
+		{name: "template", template: "{slug}", wantErr: true},
+		{name: "template", template: "{uuid|truncate:8}", want: templateStrategy{}},
+		{name: "template", template: "{uuid|truncate:1}", wantErr: true},
+		{name: "template", template: "{uuid|truncate:20|truncate:7}", wantErr: true},
+		{name: "hash", template: "{uuid}", wantErr: true},
+		{name: "snowflake", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseKeyStrategy(tt.name, tt.template)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseKeyStrategy(%q, %q) = %T, want error", tt.name, tt.template, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseKeyStrategy(%q, %q) error: %v", tt.name, tt.template, err)
+			continue
+		}
+		if gotType, wantType := typeName(got), typeName(tt.want); gotType != wantType {
+			t.Errorf("parseKeyStrategy(%q, %q) = %s, want %s", tt.name, tt.template, gotType, wantType)
+		}
+	}
+}
+
+func typeName(s KeyStrategy) string {
+	switch s.(type) {
+	case uuidStrategy:
+		return "uuid"
+	case hashStrategy:
+		return "hash"
+	case idempotentStrategy:
+		return "idempotent"
+	case timestampStrategy:
+		return "timestamp"
+	case templateStrategy:
+		return "template"
+	}
+	return "unknown"
+}
+
+func TestUUIDStrategy(t *testing.T) {
+	defer func(enabled bool) { slugEnabled = enabled }(slugEnabled)
+	pattern := `[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`
+
+	slugEnabled = false
+	key := uuidStrategy{}.Key(KeyInput{Original: "My Photo.jpg", Now: testNow})
+	if !regexp.MustCompile(`^` + pattern + `\.jpg$`).MatchString(key) {
+		t.Errorf("key = %q, want <uuid>.jpg", key)
+	}
+	if other := (uuidStrategy{}).Key(KeyInput{Original: "My Photo.jpg", Now: testNow}); other == key {
+		t.Errorf("two keys for the same input are both %q", key)
+	}
+
+	slugEnabled = true
+	key = uuidStrategy{}.Key(KeyInput{Original: "My Photo.jpg", Now: testNow})
+	if !regexp.MustCompile(`^` + pattern + `-my-photo\.jpg$`).MatchString(key) {
+		t.Errorf("key = %q, want <uuid>-my-photo.jpg", key)
+	}
+}
+
+func TestHashStrategy(t *testing.T) {
+	sum := strings.Repeat("ab", 32)
+	key := hashStrategy{}.Key(KeyInput{Original: "photo.png", SHA256: sum, Now: testNow})
+	if want := sum + ".png"; key != want {
+		t.Errorf("key = %q, want %q", key, want)
+	}
+	if again := (hashStrategy{}).Key(KeyInput{Original: "other.png", SHA256: sum}); again != key {
+		t.Errorf("same content got keys %q and %q", key, again)
+	}
+}
+
+func TestIdempotentStrategy(t *testing.T) {
+	sum := strings.Repeat("ab", 32)
+	in := KeyInput{Original: "photo.png", SHA256: sum, LogicalID: "user/42/avatar", Now: testNow}
+	key := idempotentStrategy{}.Key(in)
+	if !regexp.MustCompile(`^[0-9a-f]{64}\.png$`).MatchString(key) {
+		t.Errorf("key = %q, want <sha256>.png", key)
+	}
+	if retry := (idempotentStrategy{}).Key(in); retry != key {
+		t.Errorf("retry got key %q, want %q", retry, key)
+	}
+	in.LogicalID = "user/43/avatar"
+	if other := (idempotentStrategy{}).Key(in); other == key {
+		t.Errorf("different logical IDs share key %q", key)
+	}
+	in.LogicalID = ""
+	if plain := (idempotentStrategy{}).Key(in); plain != sum+".png" {
+		t.Errorf("key without a logical ID = %q, want the content hash", plain)
+	}
+}
+
+func TestTimestampStrategy(t *testing.T) {
+	key := timestampStrategy{}.Key(KeyInput{Original: "photo.webp", Now: testNow})
+	if !regexp.MustCompile(`^20240506T070809\.123456789Z-[0-9a-f]{8}\.webp$`).MatchString(key) {
+		t.Errorf("key = %q, want 20240506T070809.123456789Z-<hex>.webp", key)
+	}
+	later := timestampStrategy{}.Key(KeyInput{Original: "photo.webp", Now: testNow.Add(time.Nanosecond)})
+	if later <= key {
+		t.Errorf("later key %q does not sort after %q", later, key)
+	}
+	if same := (timestampStrategy{}).Key(KeyInput{Original: "photo.webp", Now: testNow}); same == key {
+		t.Errorf("two keys in the same nanosecond are both %q", key)
+	}
+}
+
+func TestTemplateStrategy(t *testing.T) {
+	strategy, err := parseKeyStrategy("template", "{now|format:2006/01}/{slug|truncate:5}-{uuid|short}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := strategy.Key(KeyInput{Original: "Holiday Photo.JPG", Now: testNow})
+	if !regexp.MustCompile(`^2024/05/holid-[0-9a-f]{8}\.JPG$`).MatchString(key) {
+		t.Errorf("key = %q, want 2024/05/holid-<short uuid>.JPG", key)
+	}
+}
+
+func TestGenerateFileNameAddsPrefixAndShard(t *testing.T) {
+	defer func(s KeyStrategy, n int) { keyStrategy, keyShardLength = s, n }(keyStrategy, keyShardLength)
+	keyStrategy = hashStrategy{}
+	sum := strings.Repeat("0", 64)
+
+	keyShardLength = 0
+	if got, want := generateFileName("uploads/", KeyInput{Original: "a.png", SHA256: sum}), "uploads/"+sum+".png"; got != want {
+		t.Errorf("generateFileName = %q, want %q", got, want)
+	}
+
+	keyShardLength = 2
+	got := generateFileName("uploads/", KeyInput{Original: "a.png", SHA256: sum})
+	if !regexp.MustCompile(`^uploads/[0-9a-f]{2}/` + sum + `\.png$`).MatchString(got) {
+		t.Errorf("generateFileName = %q, want uploads/<shard>/<hash>.png", got)
+	}
+}
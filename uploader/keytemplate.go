@@ -0,0 +1,157 @@
+package uploader
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const defaultKeyDateLayout = "2006-01-02"
+
+var keyLiteralPattern = regexp.MustCompile(`^[A-Za-z0-9/_.-]+$`)
+
+// keySegment is either literal text or a {variable|func:arg|...} placeholder.
+type keySegment struct {
+	literal  string
+	variable string
+	layout   string // for {now}
+	funcs    []func(string) string
+}
+
+// parseKeyTemplate validates everything up front, so rendering a key can
+// never fail at upload time.
+func parseKeyTemplate(tmpl string) ([]keySegment, error) {
+	var segments []keySegment
+	hasUUID := false
+	for tmpl != "" {
+		open := strings.IndexByte(tmpl, '{')
+		if open != 0 {
+			literal := tmpl
+			if open > 0 {
+				literal = tmpl[:open]
+			}
+			if !keyLiteralPattern.MatchString(literal) || strings.Contains(literal, "..") {
+				return nil, fmt.Errorf("literal text %q may only contain letters, digits, /, -, _ and single dots", literal)
+			}
+			segments = append(segments, keySegment{literal: literal})
+			tmpl = tmpl[len(literal):]
+			continue
+		}
+
+		end := strings.IndexByte(tmpl, '}')
+		if end < 0 {
+			return nil, errors.New("unclosed {")
+		}
+		segment, err := parsePlaceholder(tmpl[1:end])
+		if err != nil {
+			return nil, err
+		}
+		hasUUID = hasUUID || segment.variable == "uuid"
+		segments = append(segments, segment)
+		tmpl = tmpl[end+1:]
+	}
+	if !hasUUID {
+		return nil, errors.New("must include {uuid} so keys stay unique")
+	}
+	return segments, nil
+}
+
+func parsePlaceholder(body string) (keySegment, error) {
+	specs := strings.Split(body, "|")
+	segment := keySegment{variable: specs[0]}
+	switch segment.variable {
+	case "uuid", "slug":
+	case "now":
+		segment.layout = defaultKeyDateLayout
+	default:
+		return keySegment{}, fmt.Errorf("unknown variable {%s}; use uuid, slug or now", segment.variable)
+	}
+
+	for i, spec := range specs[1:] {
+		name, arg, hasArg := strings.Cut(spec, ":")
+		if hasArg != (name == "format" || name == "truncate") {
+			return keySegment{}, fmt.Errorf("{%s}: wrong arguments for function %q", body, name)
+		}
+		switch name {
+		case "format":
+			if segment.variable != "now" || i != 0 {
+				return keySegment{}, fmt.Errorf("{%s}: format must come first and only applies to now", body)
+			}
+			sample := time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC).Format(arg)
+			if !keyLiteralPattern.MatchString(sample) || strings.Contains(sample, "..") {
+				return keySegment{}, fmt.Errorf("{%s}: layout produces characters not allowed in keys", body)
+			}
+			segment.layout = arg
+		case "truncate":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 {
+				return keySegment{}, fmt.Errorf("{%s}: truncate needs a positive length", body)
+			}
+			// Fewer random characters than short keeps would let new uploads
+			// overwrite old ones.
+			if segment.variable == "uuid" && n < 8 {
+				return keySegment{}, fmt.Errorf("{%s}: truncating uuid below 8 characters makes keys collide", body)
+			}
+			segment.funcs = append(segment.funcs, truncateFunc(n))
+		case "short":
+			segment.funcs = append(segment.funcs, truncateFunc(8))
+		case "lower":
+			segment.funcs = append(segment.funcs, strings.ToLower)
+		case "upper":
+			segment.funcs = append(segment.funcs, strings.ToUpper)
+		default:
+			return keySegment{}, fmt.Errorf("{%s}: unknown function %q", body, name)
+		}
+	}
+	return segment, nil
+}
+
+func truncateFunc(n int) func(string) string {
+	return func(s string) string {
+		if r := []rune(s); len(r) > n {
+			return string(r[:n])
+		}
+		return s
+	}
+}
+
+// renderKeyTemplate builds the key (without prefix) for original. Empty
+// values such as a missing slug leave stray separators behind, so each path
+// segment is trimmed and empty ones are dropped.
+func renderKeyTemplate(segments []keySegment, original string, now time.Time) string {
+	ext := filepath.Ext(original)
+	values := map[string]string{
+		"uuid": uuid.New().String(),
+		"slug": slugify(strings.TrimSuffix(filepath.Base(original), ext)),
+	}
+
+	var b strings.Builder
+	for _, segment := range segments {
+		if segment.variable == "" {
+			b.WriteString(segment.literal)
+			continue
+		}
+		value := values[segment.variable]
+		if segment.variable == "now" {
+			value = now.UTC().Format(segment.layout)
+		}
+		for _, fn := range segment.funcs {
+			value = fn(value)
+		}
+		b.WriteString(value)
+	}
+
+	var parts []string
+	for _, part := range strings.Split(b.String(), "/") {
+		if part = strings.Trim(part, "-_."); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "/") + ext
+}
@@ -0,0 +1,259 @@
+package uploader
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// localFilesPath is where the service serves a local store itself when
+// LOCAL_PUBLIC_URL doesn't point somewhere else.
+const localFilesPath = "/files/"
+
+// Files being written are hidden under this prefix until renamed into place.
+const localTempPrefix = ".tmp-"
+
+var localFiles http.Handler
+
+// localStorage keeps objects as files under a directory, for development
+// and single-host setups. Files keep no headers or metadata, so they are
+// served with the type their extension implies.
+type localStorage struct {
+	dir       string
+	publicURL string
+}
+
+func initLocalStorage() {
+	dir := getenv("LOCAL_STORAGE_DIR")
+	if dir == "" {
+		fatal("Missing required environment variable: LOCAL_STORAGE_DIR")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		fatal("Invalid LOCAL_STORAGE_DIR: ", err)
+	}
+	publicURL = strings.TrimSuffix(getenv("LOCAL_PUBLIC_URL"), "/")
+	if publicURL == "" {
+		port := getenv("PORT")
+		if port == "" {
+			port = "8080"
+		}
+		publicURL = "http://localhost:" + port + strings.TrimSuffix(localFilesPath, "/")
+		localFiles = http.StripPrefix(strings.TrimSuffix(localFilesPath, "/"), serveLocalFiles(dir))
+	}
+	storage = &localStorage{dir: dir, publicURL: publicURL}
+	log.Println("Local storage enabled:", dir)
+}
+
+// serveLocalFiles serves stored files but not directory listings, which
+// would let anyone enumerate every upload.
+func serveLocalFiles(dir string) http.Handler {
+	files := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") || strings.HasPrefix(path.Base(r.URL.Path), localTempPrefix) {
+			http.NotFound(w, r)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+func (s *localStorage) path(key string) (string, error) {
+	name := filepath.FromSlash(key)
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+// Put writes to a temp file and renames it into place, so readers never see
+// a partial file.
+func (s *localStorage) Put(ctx context.Context, key string, body io.Reader, size int64, opts UploadOptions) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), localTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	var digest hash.Hash
+	if opts.ContentMD5 != "" {
+		digest = md5.New()
+		body = io.TeeReader(body, digest)
+	}
+	n, err := io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	switch {
+	case err != nil:
+		return err
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case n != size:
+		return fmt.Errorf("wrote %d of %d bytes", n, size)
+	case digest != nil && base64.StdEncoding.EncodeToString(digest.Sum(nil)) != opts.ContentMD5:
+		return errors.New("BadDigest: the Content-MD5 you specified did not match what was received")
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (s *localStorage) Get(ctx context.Context, key string) (io.ReadCloser, StoredObject, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return nil, StoredObject{}, err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, StoredObject{}, err
+	}
+	info, err := f.Stat()
+	if err == nil && info.IsDir() {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		f.Close()
+		return nil, StoredObject{}, err
+	}
+	return f, StoredObject{Key: key, Size: info.Size(), LastModified: info.ModTime()}, nil
+}
+
+func (s *localStorage) Head(ctx context.Context, key string) (StoredObject, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return StoredObject{}, err
+	}
+	info, err := os.Stat(name)
+	if err == nil && info.IsDir() {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		return StoredObject{}, err
+	}
+	return StoredObject{Key: key, Size: info.Size(), LastModified: info.ModTime()}, nil
+}
+
+// Copy writes a new file, so its modification time is the copy's. There are
+// no headers to replace.
+func (s *localStorage) Copy(ctx context.Context, from, to string, headers *ObjectHeaders) error {
+	body, obj, err := s.Get(ctx, from)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return s.Put(ctx, to, body, obj.Size, UploadOptions{})
+}
+
+func (s *localStorage) Delete(ctx context.Context, key string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *localStorage) DeleteBatch(ctx context.Context, keys []string) []error {
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		errs[i] = s.Delete(ctx, key)
+	}
+	return errs
+}
+
+// List pages through the sorted keys. The cursor is the last key of the
+// previous page.
+func (s *localStorage) List(ctx context.Context, prefix, cursor string, limit int) (ListPage, error) {
+	objects, err := s.objects(prefix)
+	if err != nil {
+		return ListPage{}, err
+	}
+	start := sort.Search(len(objects), func(i int) bool { return objects[i].Key > cursor })
+	end := min(start+limit, len(objects))
+	page := ListPage{Objects: objects[start:end]}
+	if end < len(objects) {
+		page.NextCursor = objects[end-1].Key
+	}
+	return page, nil
+}
+
+func (s *localStorage) Scan(ctx context.Context, prefix string, fn func(StoredObject)) error {
+	objects, err := s.objects(prefix)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		fn(obj)
+	}
+	return nil
+}
+
+// objects returns every file under prefix, sorted by key as S3 lists them.
+// Only the directory the prefix points into is walked.
+func (s *localStorage) objects(prefix string) ([]StoredObject, error) {
+	root, err := s.path(path.Dir(prefix + "x"))
+	if err != nil {
+		return nil, err
+	}
+	var objects []StoredObject
+	err = filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), localTempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, name)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, StoredObject{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+		return nil
+	})
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, err
+}
+
+func (s *localStorage) PresignPut(ctx context.Context, key, contentType string, size int64, expiry time.Duration) (PresignedPut, error) {
+	return PresignedPut{}, errPresignUnsupported
+}
+
+func (s *localStorage) PublicURL(ctx context.Context, key string) (string, error) {
+	return s.publicURL + "/" + key, nil
+}
+
+func (s *localStorage) Ping(ctx context.Context) error {
+	_, err := os.Stat(s.dir)
+	return err
+}
@@ -0,0 +1,144 @@
+package uploader
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// requestIDPattern bounds the X-Request-ID a client or proxy may supply, so
+// it can't inject anything into the logs.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestInfo collects what the access log line reports about a request.
+// Handlers further in fill in the key label once the API key is checked.
+type requestInfo struct {
+	id       string
+	keyLabel string
+}
+
+// textLogger is the logger LOG_FORMAT=json replaced, put back when a later
+// Server logs as text.
+var textLogger *slog.Logger
+
+// initLogging runs first in New, so every later line, including the config
+// error New returns when main logs it, uses the chosen format. With
+// LOG_FORMAT=json, log.Println calls are written as JSON too.
+func initLogging() {
+	switch format := getenv("LOG_FORMAT"); format {
+	case "", "text":
+		if textLogger != nil {
+			slog.SetDefault(textLogger)
+			textLogger = nil
+		}
+	case "json":
+		if textLogger == nil {
+			textLogger = slog.Default()
+		}
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+	default:
+		fatal("Invalid LOG_FORMAT: must be text or json")
+	}
+}
+
+func requestInfoFrom(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoCtx).(*requestInfo)
+	return info
+}
+
+// requestID returns the ID the access log uses for r, or "" outside the
+// middleware, such as in tests that call handlers directly.
+func requestID(r *http.Request) string {
+	if info := requestInfoFrom(r); info != nil {
+		return info.id
+	}
+	return ""
+}
+
+// statusRecorder captures what a handler sent. Interim 1xx responses, such
+// as the 102 sent for progress tokens, aren't the final status.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// requestLogMiddleware tags each request with an ID, echoed in X-Request-ID,
+// and writes one structured line per request once it finishes. Only the
+// path is logged: query strings can carry an API key.
+func requestLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{id: r.Header.Get("X-Request-ID")}
+		if !requestIDPattern.MatchString(info.id) {
+			info.id = uuid.NewString()
+		}
+		w.Header().Set("X-Request-ID", info.id)
+		rec := &statusRecorder{ResponseWriter: w}
+		body := &countingBody{ReadCloser: r.Body}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoCtx, info))
+		r.Body = body
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		elapsed := time.Since(start)
+		recordRequest(r, rec.status, elapsed)
+		level := slog.LevelInfo
+		if rec.status >= 500 {
+			level = slog.LevelError
+		}
+		attrs := []any{
+			"request_id", info.id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration_ms", elapsed.Milliseconds(),
+			"bytes_uploaded", body.n,
+			"bytes_sent", rec.bytes,
+		}
+		if info.keyLabel != "" {
+			attrs = append(attrs, "key_label", info.keyLabel)
+		}
+		slog.Log(r.Context(), level, "request", attrs...)
+	})
+}
@@ -0,0 +1,100 @@
+package uploader
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+type MetadataSchema struct {
+	Allowed  []string          `json:"allowed"`
+	Required []string          `json:"required"`
+	Patterns map[string]string `json:"patterns"`
+
+	allowed  map[string]bool
+	patterns map[string]*regexp.Regexp
+}
+
+var metadataSchema *MetadataSchema
+
+var metadataKeyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+const maxMetadataBytes = 2 << 10 // R2/S3 cap user metadata at 2KB
+
+func initMetadataSchema() {
+	raw := getenv("METADATA_SCHEMA")
+	if raw == "" {
+		return
+	}
+	schema := &MetadataSchema{}
+	if err := json.Unmarshal([]byte(raw), schema); err != nil {
+		fatal("Invalid METADATA_SCHEMA: ", err)
+	}
+	schema.allowed = map[string]bool{}
+	for _, key := range schema.Allowed {
+		schema.allowed[key] = true
+	}
+	for _, key := range schema.Required {
+		schema.allowed[key] = true
+	}
+	schema.patterns = map[string]*regexp.Regexp{}
+	for key, pattern := range schema.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			fatalf("Invalid METADATA_SCHEMA pattern for %q: %v", key, err)
+		}
+		schema.patterns[key] = re
+		schema.allowed[key] = true
+	}
+	metadataSchema = schema
+}
+
+// parseMetadata decodes a client-supplied JSON object of string values and
+// checks it against the configured schema, naming the first offending field.
+func parseMetadata(raw string) (map[string]string, error) {
+	meta := map[string]string{}
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &meta); err != nil {
+			return nil, fmt.Errorf("metadata must be a JSON object of string values")
+		}
+	}
+
+	keys := make([]string, 0, len(meta))
+	size := 0
+	for key, value := range meta {
+		keys = append(keys, key)
+		size += len(key) + len(value)
+	}
+	sort.Strings(keys)
+	if size > maxMetadataBytes {
+		return nil, fmt.Errorf("metadata exceeds %d bytes", maxMetadataBytes)
+	}
+
+	for _, key := range keys {
+		if !metadataKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("metadata key %q must be lowercase letters, digits, - or _", key)
+		}
+		if metadataSchema == nil {
+			continue
+		}
+		if len(metadataSchema.allowed) > 0 && !metadataSchema.allowed[key] {
+			return nil, fmt.Errorf("metadata key %q is not allowed", key)
+		}
+		if re, ok := metadataSchema.patterns[key]; ok && !re.MatchString(meta[key]) {
+			return nil, fmt.Errorf("metadata %q value does not match pattern %s", key, re)
+		}
+	}
+	if metadataSchema != nil {
+		for _, key := range metadataSchema.Required {
+			if _, ok := meta[key]; !ok {
+				return nil, fmt.Errorf("metadata key %q is required", key)
+			}
+		}
+	}
+
+	if len(meta) == 0 {
+		return nil, nil
+	}
+	return meta, nil
+}
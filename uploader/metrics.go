@@ -0,0 +1,190 @@
+package uploader
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var metricsEnabled bool
+var metricsToken string
+
+// durationBuckets are histogram bounds in seconds, from a small image on a
+// fast link to a large file near the default timeout.
+var durationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// counterVec is a Prometheus counter keyed by its rendered label set.
+type counterVec struct {
+	sync.Mutex
+	values map[string]float64
+}
+
+func (c *counterVec) add(labels string, v float64) {
+	c.Lock()
+	defer c.Unlock()
+	if c.values == nil {
+		c.values = map[string]float64{}
+	}
+	c.values[labels] += v
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, plus +Inf at the end
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	sync.Mutex
+	series map[string]*histogram
+}
+
+func (h *histogramVec) observe(labels string, v float64) {
+	h.Lock()
+	defer h.Unlock()
+	if h.series == nil {
+		h.series = map[string]*histogram{}
+	}
+	s := h.series[labels]
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(durationBuckets)+1)}
+		h.series[labels] = s
+	}
+	s.counts[sort.SearchFloat64s(durationBuckets, v)]++
+	s.sum += v
+	s.count++
+}
+
+var (
+	uploadsTotal       counterVec
+	uploadFailures     counterVec
+	uploadDuration     histogramVec
+	storageBytes       counterVec
+	httpRequests       counterVec
+	httpRequestSeconds histogramVec
+)
+
+// knownMethods keeps the method label bounded; anything else is "other".
+var knownMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodDelete: true, http.MethodOptions: true, http.MethodPatch: true,
+}
+
+func initMetrics() {
+	metricsEnabled = envBool("METRICS")
+	metricsToken = getenv("METRICS_TOKEN")
+	// Export the unlabelled counter before the first upload, so rate()
+	// sees it start from zero.
+	uploadsTotal.add("", 0)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels renders name/value pairs as a Prometheus label set.
+func labels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+`="`+labelEscaper.Replace(pairs[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// recordUpload counts a stored file and the time its bytes took to reach
+// storage.
+func recordUpload(elapsed time.Duration) {
+	uploadsTotal.add("", 1)
+	uploadDuration.observe("", elapsed.Seconds())
+}
+
+func recordUploadFailure(reason string) {
+	uploadFailures.add(labels("reason", reason), 1)
+}
+
+// recordRequest is called by requestLogMiddleware. Requests are labelled by
+// the route pattern that served them, never the raw path, so keys in
+// /images/{key} can't create a series each.
+func recordRequest(r *http.Request, status int, elapsed time.Duration) {
+	method := r.Method
+	if !knownMethods[method] {
+		method = "other"
+	}
+	route := r.Pattern
+	if route == "" {
+		route = "none"
+	}
+	httpRequests.add(labels("method", method, "route", route, "code", strconv.Itoa(status)), 1)
+	httpRequestSeconds.observe(labels("route", route), elapsed.Seconds())
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if metricsToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+metricsToken)) != 1 {
+		sendJSON(w, 401, map[string]interface{}{
+			"status":  401,
+			"message": "Unauthorized: metrics token required",
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeCounter(w, "image_upload_files_total", "Files stored by /upload and /upload/raw.", &uploadsTotal)
+	writeCounter(w, "image_upload_failures_total", "Files rejected or not stored, by reason.", &uploadFailures)
+	writeHistogram(w, "image_upload_duration_seconds", "Time to write one uploaded file to storage.", &uploadDuration)
+	writeCounter(w, "image_upload_storage_bytes_total", "Bytes written to storage, including variants, by backend.", &storageBytes)
+	writeCounter(w, "image_upload_http_requests_total", "HTTP requests by method, route and status code.", &httpRequests)
+	writeHistogram(w, "image_upload_http_request_duration_seconds", "HTTP request duration by route.", &httpRequestSeconds)
+}
+
+func writeCounter(w io.Writer, name, help string, c *counterVec) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	c.Lock()
+	defer c.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", name, key, formatFloat(c.values[key]))
+	}
+}
+
+func writeHistogram(w io.Writer, name, help string, h *histogramVec) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	h.Lock()
+	defer h.Unlock()
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		// Bucket counts are cumulative, with le added to the series' labels.
+		inner := strings.TrimSuffix(strings.TrimPrefix(key, "{"), "}")
+		if inner != "" {
+			inner += ","
+		}
+		var cumulative uint64
+		for i, bound := range durationBuckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, inner, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, inner, s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, key, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, key, s.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,77 @@
+package uploader
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const contentTypeMsgpack = "application/msgpack"
+
+// negotiatedWriter marks a response whose client asked for MessagePack, so
+// sendJSON can pick the encoding without every handler passing the request.
+type negotiatedWriter struct {
+	http.ResponseWriter
+}
+
+func (w *negotiatedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func negotiateMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if acceptsMsgpack(r.Header.Get("Accept")) {
+			w = &negotiatedWriter{w}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acceptsMsgpack reports whether the Accept header lists MessagePack with a
+// non-zero quality at least as high as JSON's. Anything else, including a
+// missing header or */*, gets JSON.
+func acceptsMsgpack(accept string) bool {
+	msgpackQ, jsonQ := 0.0, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case contentTypeMsgpack, "application/x-msgpack":
+			msgpackQ = max(msgpackQ, q)
+		case "application/json":
+			jsonQ = max(jsonQ, q)
+		}
+	}
+	return msgpackQ > 0 && msgpackQ >= jsonQ
+}
+
+// encodeMsgpack converts the JSON encoding of a response to MessagePack, so
+// both carry the same field names, omitted fields and timestamp format.
+// Whole numbers are packed as integers.
+func encodeMsgpack(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.UseCompactInts(true)
+	enc.UseCompactFloats(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,221 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// formMemory is how much of a multipart form is held in memory; the rest of
+// the files spill to temp files, which uploadForm.RemoveAll deletes.
+var formMemory int64 = 32 << 20
+
+// Objects bigger than one part go up as an S3 multipart upload.
+var multipartPartSize int64 = 16 << 20
+var multipartConcurrency = 4
+
+func initMultipart() {
+	formMemory = int64(envInt("FORM_MEMORY_MB", int(formMemory>>20))) << 20
+	mb := envInt("MULTIPART_PART_SIZE_MB", int(multipartPartSize>>20))
+	if int64(mb)<<20 < manager.MinUploadPartSize || mb > 5120 {
+		fatal("Invalid MULTIPART_PART_SIZE_MB: must be between 5 and 5120")
+	}
+	multipartPartSize = int64(mb) << 20
+	multipartConcurrency = envInt("MULTIPART_CONCURRENCY", multipartConcurrency)
+}
+
+// putObject stores input with a single PutObject, or in parts once it is
+// larger than MULTIPART_PART_SIZE_MB, so a failed part is retried alone
+// instead of the whole file. The uploader aborts the multipart upload if
+// it fails. Content-MD5 only covers single-part objects; S3 has no
+// whole-object MD5 for multipart uploads.
+func putObject(ctx context.Context, client *s3.Client, input *s3.PutObjectInput) error {
+	if aws.ToInt64(input.ContentLength) <= multipartPartSize {
+		_, err := client.PutObject(ctx, input)
+		return err
+	}
+	uploader := manager.NewUploader(client, func(u *manager.Uploader) {
+		u.PartSize = multipartPartSize
+		u.Concurrency = multipartConcurrency
+	})
+	_, err := uploader.Upload(ctx, input)
+	return err
+}
+
+// uploadForm is an /upload body read part by part with r.MultipartReader.
+// Files stay seekable, since every content check rewinds them and the batch
+// uploads them concurrently: in memory up to FORM_MEMORY_MB in all, in temp
+// files after that.
+type uploadForm struct {
+	Value map[string][]string
+	File  map[string][]*formFile
+}
+
+// formFile is one file part. A part over the size limit is read to the end
+// but not kept, so Size still reports it and Open fails.
+type formFile struct {
+	Filename string
+	Header   textproto.MIMEHeader
+	Size     int64
+	content  []byte
+	tmpfile  string
+	dropped  bool
+}
+
+var (
+	errTooManyFiles = errors.New("too many files")
+	errPartDropped  = errors.New("part was not kept")
+)
+
+type memFile struct{ *bytes.Reader }
+
+func (memFile) Close() error { return nil }
+
+func (f *formFile) Open() (multipart.File, error) {
+	switch {
+	case f.dropped:
+		return nil, errPartDropped
+	case f.tmpfile != "":
+		return os.Open(f.tmpfile)
+	}
+	return memFile{bytes.NewReader(f.content)}, nil
+}
+
+// readUploadForm reads r's multipart body and fills r.Form and r.PostForm as
+// ParseMultipartForm would. It gives up as soon as a part would take the
+// request past fileLimit files: a client merging duplicate fields (see
+// UPLOAD_FIELD_POLICY) may send up to fileLimit per accepted field. Files
+// over sizeLimit are stopped at the limit rather than written out. The
+// caller owns the form and must call RemoveAll.
+func readUploadForm(r *http.Request, sizeLimit int64, fileLimit int) (*uploadForm, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	form := &uploadForm{Value: map[string][]string{}, File: map[string][]*formFile{}}
+	memory, fieldBytes := formMemory, int64(multipartOverhead)
+	parts := 0
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			form.RemoveAll()
+			return nil, err
+		}
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+		if part.FileName() == "" {
+			var value bytes.Buffer
+			n, err := io.CopyN(&value, part, fieldBytes+1)
+			if err != nil && err != io.EOF {
+				form.RemoveAll()
+				return nil, err
+			}
+			if fieldBytes -= n; fieldBytes < 0 {
+				form.RemoveAll()
+				return nil, multipart.ErrMessageTooLarge
+			}
+			form.Value[name] = append(form.Value[name], value.String())
+			continue
+		}
+
+		if parts++; parts > fileLimit*len(uploadFields) {
+			form.RemoveAll()
+			return nil, errTooManyFiles
+		}
+		file := &formFile{Filename: part.FileName(), Header: part.Header}
+		form.File[name] = append(form.File[name], file)
+		// A field collectUploadFiles will refuse only needs its name.
+		limit := sizeLimit
+		if !slices.Contains(uploadFields, name) {
+			limit = 0
+		}
+		if err := file.read(part, limit, &memory); err != nil {
+			form.RemoveAll()
+			return nil, err
+		}
+	}
+
+	r.PostForm = form.Value
+	r.Form = url.Values{}
+	for name, values := range form.Value {
+		r.Form[name] = slices.Clone(values)
+	}
+	for name, values := range r.URL.Query() {
+		r.Form[name] = append(r.Form[name], values...)
+	}
+	return form, nil
+}
+
+// read stores part in memory while the form's budget lasts and in a temp
+// file after that, up to limit bytes.
+func (f *formFile) read(part io.Reader, limit int64, memory *int64) error {
+	var head bytes.Buffer
+	inMemory := min(*memory, limit)
+	n, err := io.CopyN(&head, part, inMemory+1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n <= inMemory {
+		*memory -= n
+		f.content, f.Size = head.Bytes(), n
+		return nil
+	}
+	if n <= limit {
+		tmp, err := os.CreateTemp("", "upload-")
+		if err != nil {
+			return err
+		}
+		f.tmpfile = tmp.Name()
+		f.Size, err = io.Copy(tmp, io.MultiReader(&head, io.LimitReader(part, limit+1-n)))
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil || f.Size <= limit {
+			return err
+		}
+		os.Remove(f.tmpfile)
+		f.tmpfile, n = "", f.Size
+	}
+	rest, err := io.Copy(io.Discard, part)
+	f.Size, f.dropped = n+rest, true
+	return err
+}
+
+// RemoveAll deletes the form's temp files.
+func (form *uploadForm) RemoveAll() error {
+	var err error
+	for _, files := range form.File {
+		for _, f := range files {
+			if e := f.remove(); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+func (f *formFile) remove() error {
+	if f.tmpfile == "" {
+		return nil
+	}
+	if err := os.Remove(f.tmpfile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package uploader
+
+import (
+	"bytes"
+	"io"
+)
+
+var polyglotCheck bool
+
+// polyglotMarkers start markup or script that a browser or interpreter would
+// act on. None is part of any image structure (XMP uses <x:xmpmeta and
+// <?xpacket), and compressed data is very unlikely to spell one by chance.
+var polyglotMarkers = [][]byte{
+	[]byte("<script"),
+	[]byte("<html"),
+	[]byte("<body"),
+	[]byte("<iframe"),
+	[]byte("<object"),
+	[]byte("<embed"),
+	[]byte("<svg"),
+	[]byte("<!doctype"),
+	[]byte("<?php"),
+	[]byte("javascript:"),
+	[]byte("onerror="),
+	[]byte("onload="),
+}
+
+// markerOverlap is carried between reads so markers split across two reads
+// are still found. It must be longer than every marker.
+const markerOverlap = 16
+
+// PNG's IEND chunk has no data, so its CRC is always the same.
+var pngEnd = []byte("IEND\xaeB`\x82")
+
+// A ZIP's end-of-central-directory record sits within the last 64KB + 22
+// bytes of the archive, which is where it ends up when one is appended.
+var zipEnd = []byte("PK\x05\x06")
+
+const zipTailSize = 65535 + 22
+
+// detectPolyglot looks for content that lets an image also parse as
+// something else. It returns what it found, or "" for a clean file:
+//   - markup or script markers anywhere in the file, case-insensitively;
+//   - data after a PNG's IEND chunk;
+//   - a ZIP archive appended to the image;
+//   - a GIF whose width bytes open a JavaScript comment, the classic GIF/JS
+//     polyglot.
+func detectPolyglot(r io.Reader) (string, error) {
+	var head, carry, tail []byte
+	var total int64
+	pngEndAt := int64(-1)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := r.Read(buf)
+		chunk := buf[:n]
+		if len(head) < 8 {
+			head = append(head, chunk[:min(8-len(head), n)]...)
+		}
+
+		window := append(append([]byte{}, carry...), chunk...)
+		lower := bytes.ToLower(window)
+		for _, marker := range polyglotMarkers {
+			if bytes.Contains(lower, marker) {
+				return "embedded " + string(marker), nil
+			}
+		}
+		if i := bytes.LastIndex(window, pngEnd); i >= 0 {
+			pngEndAt = total - int64(len(carry)) + int64(i+len(pngEnd))
+		}
+		tail = append(tail, chunk...)
+		if len(tail) > zipTailSize {
+			tail = append([]byte{}, tail[len(tail)-zipTailSize:]...)
+		}
+		carry = append([]byte{}, window[max(0, len(window)-markerOverlap):]...)
+		total += int64(n)
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")) && pngEndAt >= 0 && total > pngEndAt:
+		return "data after the end of the PNG", nil
+	case bytes.Contains(tail, zipEnd):
+		return "appended ZIP archive", nil
+	case (bytes.HasPrefix(head, []byte("GIF87a")) || bytes.HasPrefix(head, []byte("GIF89a"))) && len(head) == 8 && string(head[6:8]) == "/*":
+		return "GIF header that opens a script comment", nil
+	}
+	return "", nil
+}
@@ -0,0 +1,152 @@
+package uploader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var presignedUploads bool
+var presignUploadExpiry = 15 * time.Minute
+
+type PresignRequest struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Folder      string `json:"folder"`
+	LogicalID   string `json:"logical_id"`
+}
+
+type PresignResponse struct {
+	Status    int    `json:"status"`
+	Message   string `json:"message"`
+	UploadURL string `json:"upload_url,omitempty"`
+	Method    string `json:"method,omitempty"`
+	// Headers must be sent with the PUT exactly as given; they are part of
+	// the signature.
+	Headers   map[string]string `json:"headers,omitempty"`
+	Key       string            `json:"key,omitempty"`
+	URL       string            `json:"url,omitempty"`
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+}
+
+func initPresign() {
+	presignedUploads = envBool("PRESIGNED_UPLOADS")
+	presignUploadExpiry = envDuration("PRESIGN_UPLOAD_EXPIRY", presignUploadExpiry)
+	if presignedUploads && (presignUploadExpiry < time.Second || presignUploadExpiry > 7*24*time.Hour) {
+		fatal("Invalid PRESIGN_UPLOAD_EXPIRY: must be between 1s and 168h")
+	}
+}
+
+func presignError(w http.ResponseWriter, status int, message string) {
+	sendJSON(w, status, PresignResponse{Status: status, Message: message})
+}
+
+// presignHandler lets a client PUT one image straight to R2. The name, type
+// and size are checked against the same rules as /upload, and the type and
+// size are signed into the URL, but the bytes never pass through here: the
+// content checks, fallback backend and quotas can't apply.
+func presignHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) || !allowOperation(w, r, opUpload) {
+		return
+	}
+
+	var req PresignRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		presignError(w, 400, "Invalid JSON body")
+		return
+	}
+	label := keyLabel(r)
+	sizeLimit, _ := uploadLimitsFor(label)
+	if hasQuota(label) || hasDailyQuota(label) {
+		presignError(w, 403, "Presigned uploads are not available for keys with a storage or daily quota")
+		return
+	}
+	if usesContentHash() {
+		presignError(w, 400, "Presigned uploads need a key strategy that doesn't hash the content")
+		return
+	}
+
+	name := filepath.Base(req.Filename)
+	if req.Filename == "" {
+		presignError(w, 400, "filename required")
+		return
+	}
+	if !isAllowedImage(name) {
+		presignError(w, 400, "Invalid type (allowed: "+allowedExtensionList()+")")
+		return
+	}
+	contentType := detectContentType(name)
+	if declared := strings.TrimSpace(strings.Split(req.ContentType, ";")[0]); declared != "" && declared != contentType {
+		presignError(w, 400, "content_type "+declared+" does not match the extension's type "+contentType)
+		return
+	}
+	if isTypeDisabled(contentType) {
+		presignError(w, 400, "Type "+contentType+" is temporarily disabled")
+		return
+	}
+	switch {
+	case req.Size <= 0:
+		presignError(w, 400, "size required")
+		return
+	case req.Size < minFileSize:
+		presignError(w, 400, fmt.Sprintf("File is below %d byte minimum", minFileSize))
+		return
+	case req.Size > sizeLimit:
+		presignError(w, 413, fmt.Sprintf("File exceeds %dMB limit", sizeLimit>>20))
+		return
+	}
+	if usesLogicalID() && req.LogicalID != "" {
+		if err := checkLogicalID(req.LogicalID); err != nil {
+			presignError(w, 400, err.Error())
+			return
+		}
+	}
+	folder, err := uploadFolder(label, req.Folder)
+	if err != nil {
+		presignError(w, 400, err.Error())
+		return
+	}
+
+	key := generateFileName(uploadPrefixFor(label)+folder, KeyInput{Original: name, LogicalID: req.LogicalID, Now: time.Now()})
+	expiresAt := time.Now().Add(presignUploadExpiry).UTC().Truncate(time.Second)
+	signed, err := storage.PresignPut(r.Context(), key, contentType, req.Size, presignUploadExpiry)
+	if errors.Is(err, errPresignUnsupported) {
+		presignError(w, 501, "Presigned uploads are not supported by the storage backend")
+		return
+	}
+	if err != nil {
+		log.Println("Failed to presign upload for", key+":", err)
+		presignError(w, 502, "Failed to create upload URL")
+		return
+	}
+	url, err := objectURL(r.Context(), key)
+	if err != nil {
+		log.Println("Failed to build URL for", key+":", err)
+		presignError(w, 502, "Failed to create upload URL")
+		return
+	}
+
+	headers := map[string]string{}
+	for name, values := range signed.Headers {
+		if !strings.EqualFold(name, "Host") {
+			headers[name] = strings.Join(values, ",")
+		}
+	}
+	sendJSON(w, 200, PresignResponse{
+		Status:    200,
+		Message:   "Upload URL created",
+		UploadURL: signed.URL,
+		Method:    signed.Method,
+		Headers:   headers,
+		Key:       key,
+		URL:       url,
+		ExpiresAt: &expiresAt,
+	})
+}
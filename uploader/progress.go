@@ -0,0 +1,139 @@
+package uploader
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var progressTTL = 5 * time.Minute
+var progressTokenPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{16,64}$`)
+
+var errProgressToken = errors.New("Invalid X-Progress-Token: must be 16-64 letters, digits, - or _")
+var errProgressTokenInUse = errors.New("Progress token already in use")
+
+// uploadProgress is the polled view of one in-flight batch. Entries stay
+// registered for progressTTL after the batch finishes, then are dropped.
+type uploadProgress struct {
+	mu        sync.Mutex
+	token     string
+	label     string
+	state     string
+	total     int
+	completed int
+	failed    int
+	bytes     int64
+	updatedAt time.Time
+}
+
+type ProgressResponse struct {
+	Status    int       `json:"status"`
+	State     string    `json:"state"`
+	Total     int       `json:"total"`
+	Completed int       `json:"completed"`
+	Failed    int       `json:"failed"`
+	Bytes     int64     `json:"bytes"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var progressStore = struct {
+	sync.Mutex
+	entries map[string]*uploadProgress
+}{entries: map[string]*uploadProgress{}}
+
+func initProgress() {
+	progressTTL = envDuration("PROGRESS_TTL", progressTTL)
+}
+
+// startProgress registers progress tracking when the client asks for it,
+// either with its own X-Progress-Token or with ?progress=true for a
+// generated one. The token goes out at once in a 102 interim response, so
+// clients that can read it start polling while the batch is still running;
+// the final response carries it too.
+func startProgress(w http.ResponseWriter, r *http.Request, label string, total int) (*uploadProgress, error) {
+	token := r.Header.Get("X-Progress-Token")
+	if token == "" {
+		if r.URL.Query().Get("progress") != "true" {
+			return nil, nil
+		}
+		token = strings.ReplaceAll(uuid.New().String(), "-", "")
+	} else if !progressTokenPattern.MatchString(token) {
+		return nil, errProgressToken
+	}
+
+	p := &uploadProgress{token: token, label: label, state: "running", total: total, updatedAt: time.Now()}
+	progressStore.Lock()
+	if _, exists := progressStore.entries[token]; exists {
+		progressStore.Unlock()
+		return nil, errProgressTokenInUse
+	}
+	progressStore.entries[token] = p
+	progressStore.Unlock()
+
+	w.Header().Set("X-Progress-Token", token)
+	w.WriteHeader(http.StatusProcessing)
+	return p, nil
+}
+
+func (p *uploadProgress) record(ok bool, size int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ok {
+		p.completed++
+		p.bytes += size
+	} else {
+		p.failed++
+	}
+	p.updatedAt = time.Now()
+}
+
+func (p *uploadProgress) finish() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.state = "done"
+	p.updatedAt = time.Now()
+	p.mu.Unlock()
+	time.AfterFunc(progressTTL, func() {
+		progressStore.Lock()
+		delete(progressStore.entries, p.token)
+		progressStore.Unlock()
+	})
+}
+
+func progressHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	token := strings.TrimPrefix(r.URL.Path, "/progress/")
+	progressStore.Lock()
+	p := progressStore.entries[token]
+	progressStore.Unlock()
+	// Another key's token reads as unknown rather than forbidden.
+	if p == nil || p.label != keyLabel(r) {
+		sendJSON(w, 404, map[string]interface{}{"status": 404, "message": "Unknown or expired progress token"})
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sendJSON(w, 200, ProgressResponse{
+		Status:    200,
+		State:     p.state,
+		Total:     p.total,
+		Completed: p.completed,
+		Failed:    p.failed,
+		Bytes:     p.bytes,
+		UpdatedAt: p.updatedAt,
+	})
+}
@@ -0,0 +1,212 @@
+package uploader
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Request rate limits are token buckets: each key label or client IP may
+// make RATE_LIMIT_BURST requests at once, refilled at RATE_LIMIT_RPS.
+var keyRateLimits, ipRateLimits *limiterSet
+
+// retryJitter is the most RATE_LIMIT_JITTER adds to Retry-After on a 429, so
+// clients turned away together don't all come back in the same second.
+var retryJitter time.Duration
+
+// limiterSet holds one token bucket per identity. An entry idle long enough
+// to have refilled is the same as a new one, so it is dropped; the map only
+// grows with clients active in the last refill period.
+type limiterSet struct {
+	sync.Mutex
+	limit     rate.Limit
+	burst     int
+	idle      time.Duration
+	limiters  map[string]*limiterEntry
+	lastSweep time.Time
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newLimiterSet(rps float64, burst int) *limiterSet {
+	refill := time.Duration(float64(burst) / rps * float64(time.Second))
+	return &limiterSet{
+		limit:    rate.Limit(rps),
+		burst:    burst,
+		idle:     max(time.Minute, refill),
+		limiters: map[string]*limiterEntry{},
+	}
+}
+
+// wait takes a token for id, or returns how long until one is available.
+func (s *limiterSet) wait(id string) time.Duration {
+	now := time.Now()
+	s.Lock()
+	if now.Sub(s.lastSweep) > s.idle {
+		for k, e := range s.limiters {
+			if now.Sub(e.lastSeen) > s.idle {
+				delete(s.limiters, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	e := s.limiters[id]
+	if e == nil {
+		e = &limiterEntry{limiter: rate.NewLimiter(s.limit, s.burst)}
+		s.limiters[id] = e
+	}
+	e.lastSeen = now
+	s.Unlock()
+
+	res := e.limiter.ReserveN(now, 1)
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return delay
+	}
+	return 0
+}
+
+func initRateLimit() {
+	retryJitter = envDuration("RATE_LIMIT_JITTER", retryJitter)
+	v := getenv("RATE_LIMIT_RPS")
+	if v == "" {
+		return
+	}
+	rps, err := strconv.ParseFloat(v, 64)
+	if err != nil || rps <= 0 {
+		fatal("Invalid RATE_LIMIT_RPS: must be a positive number")
+	}
+	burst := envInt("RATE_LIMIT_BURST", int(math.Ceil(rps)))
+	by := envList("RATE_LIMIT_BY")
+	if len(by) == 0 {
+		by = []string{"key"}
+	}
+	for _, scope := range by {
+		switch scope {
+		case "key":
+			keyRateLimits = newLimiterSet(rps, burst)
+		case "ip":
+			ipRateLimits = newLimiterSet(rps, burst)
+		default:
+			fatal("Invalid RATE_LIMIT_BY: must be key, ip or key,ip")
+		}
+	}
+}
+
+// rateLimited answers 429 and returns true when set has no token for id.
+func rateLimited(w http.ResponseWriter, set *limiterSet, id string) bool {
+	if set == nil {
+		return false
+	}
+	delay := set.wait(id)
+	if delay == 0 {
+		return false
+	}
+	setRetryAfter(w, delay)
+	sendJSONMulti(w, 429, nil, nil, "Rate limit exceeded, try again later")
+	return true
+}
+
+// dailyQuotas caps the bytes each key label may upload per UTC day. Unlike
+// KEY_QUOTAS, deleting files gives nothing back: the cap is on traffic, not
+// on what is stored. Usage is in memory and starts over on restart.
+var dailyQuotas = struct {
+	sync.Mutex
+	limits map[string]int64
+	used   map[string]int64
+	day    string
+}{limits: map[string]int64{}, used: map[string]int64{}}
+
+func initDailyQuotas() {
+	labels := map[string]bool{}
+	for _, label := range apiKeys {
+		labels[label] = true
+	}
+	dailyQuotas.limits = tenantQuotas(true)
+	for _, entry := range envList("KEY_DAILY_QUOTAS") {
+		label, limit, ok := strings.Cut(entry, ":")
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if !ok || err != nil || n < 1 {
+			fatal("Invalid KEY_DAILY_QUOTAS: entries must be label:maxBytes")
+		}
+		if !labels[label] {
+			fatalf("Invalid KEY_DAILY_QUOTAS: unknown key label %q", label)
+		}
+		dailyQuotas.limits[label] = n
+	}
+}
+
+func hasDailyQuota(label string) bool {
+	dailyQuotas.Lock()
+	defer dailyQuotas.Unlock()
+	_, ok := dailyQuotas.limits[label]
+	return ok
+}
+
+// resetDailyQuotas clears usage when the UTC day has changed. The caller
+// holds the lock.
+func resetDailyQuotas(now time.Time) {
+	if day := now.UTC().Format(time.DateOnly); day != dailyQuotas.day {
+		dailyQuotas.day = day
+		clear(dailyQuotas.used)
+	}
+}
+
+// reserveDailyQuota claims n bytes of label's daily allowance, like
+// reserveQuota. Bytes for uploads that fail are handed back with
+// releaseDailyQuota.
+func reserveDailyQuota(label string, n int64) (*QuotaStatus, error) {
+	now := time.Now()
+	dailyQuotas.Lock()
+	defer dailyQuotas.Unlock()
+	limit, ok := dailyQuotas.limits[label]
+	if !ok {
+		return nil, nil
+	}
+	resetDailyQuotas(now)
+	used := dailyQuotas.used[label]
+	if used+n > limit {
+		resets := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		status := &QuotaStatus{Label: label, Used: used, Limit: limit, ResetsAt: &resets}
+		return status, fmt.Errorf("Daily upload quota exceeded: %d of %d bytes used today", used, limit)
+	}
+	dailyQuotas.used[label] = used + n
+	return nil, nil
+}
+
+func releaseDailyQuota(label string, n int64) {
+	if n == 0 {
+		return
+	}
+	dailyQuotas.Lock()
+	defer dailyQuotas.Unlock()
+	if _, ok := dailyQuotas.limits[label]; ok {
+		dailyQuotas.used[label] = max(0, dailyQuotas.used[label]-n)
+	}
+}
+
+// sendDailyQuotaExceeded answers 429 with Retry-After set to the next UTC
+// midnight, when the allowance resets.
+func sendDailyQuotaExceeded(w http.ResponseWriter, quota *QuotaStatus, err error) {
+	setRetryAfter(w, time.Until(*quota.ResetsAt))
+	sendResponse(w, ApiResponse{Status: 429, Message: err.Error(), Quota: quota})
+}
+
+// setRetryAfter sets Retry-After on a 429 to wait, rounded up to a second,
+// plus a random share of RATE_LIMIT_JITTER.
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	if retryJitter > 0 {
+		wait += rand.N(retryJitter + 1)
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+}
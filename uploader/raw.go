@@ -0,0 +1,353 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var defaultBaseName = "upload"
+
+func rawUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPut) || !allowOperation(w, r, opUpload) {
+		return
+	}
+	sizeLimit, _ := uploadLimitsFor(keyLabel(r))
+	if r.ContentLength < 0 {
+		sendJSONMulti(w, 411, nil, nil, "Content-Length required")
+		return
+	}
+	if r.ContentLength == 0 {
+		sendJSONMulti(w, 400, nil, nil, "Request body is empty")
+		return
+	}
+	if r.ContentLength < minFileSize {
+		recordUploadFailure(reasonTooSmall)
+		sendJSONMulti(w, 400, nil, nil, fmt.Sprintf("File is below %d byte minimum", minFileSize))
+		return
+	}
+	if r.ContentLength > sizeLimit {
+		recordUploadFailure(reasonTooLarge)
+		sendJSONMulti(w, 413, nil, nil, fmt.Sprintf("File exceeds %dMB limit", sizeLimit>>20))
+		return
+	}
+	logRequestSizes(r, []int64{r.ContentLength})
+
+	if wait := uploadBreaker.retryAfter(); wait > 0 && fallback == nil {
+		sendUnavailable(w, wait)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, sizeLimit)
+	head, sniffed, err := sniffImage(body)
+	if err != nil {
+		recordUploadFailure(reasonOpenFailed)
+		sendJSONMulti(w, 400, nil, nil, "Failed to read request body")
+		return
+	}
+
+	if !allowedTypes[sniffed] {
+		recordUploadFailure(reasonInvalidType)
+		sendJSONMulti(w, 400, nil, nil, "Invalid image type. Allowed: "+allowedExtensionList())
+		return
+	}
+	declared := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+	if declared != "" && declared != "application/octet-stream" && declared != sniffed {
+		recordUploadFailure(reasonInvalidType)
+		sendJSONMulti(w, 400, nil, nil, "Content-Type "+declared+" does not match detected type "+sniffed)
+		return
+	}
+	if isTypeDisabled(sniffed) {
+		recordUploadFailure(reasonTypeDisabled)
+		sendJSONMulti(w, 400, nil, nil, "Type "+sniffed+" is temporarily disabled")
+		return
+	}
+
+	meta, err := parseMetadata(r.Header.Get("X-Metadata"))
+	if err != nil {
+		sendJSONMulti(w, 400, nil, nil, "Invalid metadata: "+err.Error())
+		return
+	}
+	dedupe, err := parseDedupe(r.URL.Query().Get("dedupe"))
+	if err != nil {
+		sendJSONMulti(w, 400, nil, nil, err.Error())
+		return
+	}
+	logicalID := r.Header.Get("X-Logical-Id")
+	if _, err := aliasKeyFor(keyLabel(r), logicalID, ""); err != nil {
+		sendJSONMulti(w, 400, nil, nil, err.Error())
+		return
+	}
+	if usesLogicalID() && logicalID != "" {
+		if err := checkLogicalID(logicalID); err != nil {
+			sendJSONMulti(w, 400, nil, nil, err.Error())
+			return
+		}
+	}
+	folder, err := uploadFolder(keyLabel(r), r.Header.Get("X-Upload-Prefix"))
+	if err != nil {
+		sendJSONMulti(w, 400, nil, nil, err.Error())
+		return
+	}
+
+	name, err := fallbackFilename(r.Header.Get("X-Filename"), sniffed)
+	if err != nil {
+		sendJSONMulti(w, 400, nil, nil, err.Error())
+		return
+	}
+	if given := r.Header.Get("X-Filename"); given != "" && filepath.Ext(given) != filepath.Ext(name) {
+		from := ""
+		if filepath.Ext(given) != "" {
+			from = detectContentType(given)
+		}
+		recordTypeCorrection(r, from, sniffed)
+	}
+
+	upload := io.MultiReader(bytes.NewReader(head), body)
+	var digests fileDigests
+	var imageMeta *ImageMetadata
+	budget := newFileBudget()
+	storedSize := r.ContentLength
+	if entropyCheck || polyglotCheck || hashingEnabled() || dedupe || fallback != nil || extractMetadata || stripExif {
+		// The raw body can't be rewound, so spool it like a form file (in
+		// memory up to FORM_MEMORY_MB, then to a temp file) to scan, hash,
+		// read metadata from or strip it before anything reaches R2, or to
+		// replay it against the fallback backend.
+		spool := &formFile{}
+		memory := formMemory
+		err := spool.read(upload, sizeLimit, &memory)
+		defer spool.remove()
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			recordUploadFailure(reasonTooLarge)
+			sendJSONMulti(w, 413, nil, nil, fmt.Sprintf("File exceeds %dMB limit", sizeLimit>>20))
+			return
+		}
+		var data multipart.File
+		if err == nil {
+			data, err = spool.Open()
+		}
+		if err != nil {
+			recordUploadFailure(reasonOpenFailed)
+			sendJSONMulti(w, 400, nil, nil, "Failed to read request body")
+			return
+		}
+		defer data.Close()
+		budget.start = time.Now() // the client's transfer time doesn't count
+		if entropyCheck {
+			suspicious, _ := looksEncrypted(data)
+			data.Seek(0, io.SeekStart)
+			if suspicious {
+				recordUploadFailure(reasonSuspicious)
+				sendJSONMulti(w, 422, nil, nil, "Content looks encrypted, not like an image")
+				return
+			}
+		}
+		if polyglotCheck {
+			finding, _ := detectPolyglot(data)
+			data.Seek(0, io.SeekStart)
+			if finding != "" {
+				recordUploadFailure(reasonSuspicious)
+				sendJSONMulti(w, 422, nil, nil, "Content is not a clean image: "+finding)
+				return
+			}
+		}
+		if extractMetadata && budget.allow("metadata") {
+			imageMeta = readImageMetadata(r.Context(), data)
+			data.Seek(0, io.SeekStart)
+		}
+		var buffered io.ReadSeeker = data
+		if stripExif {
+			stripped, err := stripMetadata(data, spool.Size, sniffed)
+			if err != nil {
+				recordUploadFailure(reasonInvalidType)
+				sendJSONMulti(w, 400, nil, nil, "Unreadable image")
+				return
+			}
+			buffered, storedSize = stripped, stripped.Size()
+		}
+		if hashingEnabled() || dedupe {
+			digests, _ = digestFile(buffered)
+			buffered.Seek(0, io.SeekStart)
+		}
+		upload = buffered
+	}
+
+	var header image.Config
+	var imageFormat string
+	if needsHeaderCheck(sniffed) {
+		var err error
+		if buffered, ok := upload.(io.ReadSeeker); ok {
+			header, imageFormat, err = checkDimensions(r.Context(), buffered)
+			buffered.Seek(0, io.SeekStart)
+		} else {
+			// Keep whatever the header parse consumed so it can be replayed.
+			var consumed bytes.Buffer
+			header, imageFormat, err = checkDimensions(r.Context(), io.TeeReader(upload, &consumed))
+			upload = io.MultiReader(&consumed, upload)
+		}
+		var dimErr *dimensionError
+		switch {
+		case errors.As(err, &dimErr):
+			recordUploadFailure(reasonDimensions)
+			sendJSONMulti(w, 422, nil, nil, "Image "+dimErr.Error())
+			return
+		case errors.Is(err, errDecodeBusy):
+			recordUploadFailure(reasonTimeout)
+			sendJSONMulti(w, 503, nil, nil, "Server busy, try again")
+			return
+		case err != nil:
+			recordUploadFailure(reasonInvalidType)
+			sendJSONMulti(w, 400, nil, nil, "Unreadable image")
+			return
+		}
+	}
+
+	label := keyLabel(r)
+	prefix := uploadPrefixFor(label) + folder
+	if quota, err := reserveDailyQuota(label, r.ContentLength); err != nil {
+		sendDailyQuotaExceeded(w, quota, err)
+		return
+	}
+	if quota, err := reserveQuota(label, storedSize); err != nil {
+		releaseDailyQuota(label, r.ContentLength)
+		sendResponse(w, ApiResponse{Status: 507, Message: err.Error(), Quota: quota})
+		return
+	}
+
+	keyInput := KeyInput{Original: name, SHA256: digests.SHA256Hex, LogicalID: logicalID, Now: time.Now()}
+	filename := generateFileName(strategyPrefix(label, prefix), keyInput)
+	ctx, cancel := withOptionalTimeout(r.Context(), uploadTimeout)
+	defer cancel()
+	start := time.Now()
+	var url string
+	var deduplicated bool
+	if dedupe {
+		filename = dedupeFileName(label, prefix, keyInput)
+		url, deduplicated = existingURL(ctx, filename)
+	}
+	if !deduplicated {
+		url, err = uploadToR2(ctx, upload, storedSize, filename, UploadOptions{Metadata: meta, ContentMD5: digests.MD5Base64})
+		if err != nil {
+			releaseQuota(label, storedSize)
+			releaseDailyQuota(label, r.ContentLength)
+			if errors.Is(err, context.DeadlineExceeded) {
+				recordUploadFailure(reasonTimeout)
+				sendJSONMulti(w, 504, nil, []string{"Upload timed out"}, "Upload timed out")
+				return
+			}
+			if errors.Is(err, errCircuitOpen) {
+				recordUploadFailure(reasonUnavailable)
+				sendUnavailable(w, uploadBreaker.retryAfter())
+				return
+			}
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				recordUploadFailure(reasonTooLarge)
+				sendJSONMulti(w, 413, nil, nil, fmt.Sprintf("File exceeds %dMB limit", sizeLimit>>20))
+				return
+			}
+			recordUploadFailure(reasonUploadFailed)
+			sendJSONMulti(w, 502, nil, []string{"Upload failed"}, "Upload failed")
+			return
+		}
+	}
+
+	elapsed := time.Since(start)
+	if deduplicated {
+		releaseQuota(label, storedSize)
+	} else {
+		recordUpload(elapsed)
+	}
+
+	var aliasURL, aliasError string
+	if aliasKey, _ := aliasKeyFor(label, logicalID, name); aliasKey != "" {
+		if aliasURL, err = updateAlias(r.Context(), filename, aliasKey, meta); err != nil {
+			log.Println("Alias update failed for", aliasKey+":", err)
+			aliasError = "Alias update failed"
+		}
+	}
+
+	resp := ApiResponse{Status: 200, URLs: []string{url}, Message: "1 image(s) uploaded successfully"}
+	verbose := isVerbose(r)
+	if verbose || wantsFiles(r) || contentMD5 || extractMetadata || stripExif || dedupe || (aliasesEnabled && logicalID != "") {
+		original := r.Header.Get("X-Filename")
+		if original == "" {
+			original = name
+		}
+		resp.Files = []FileResult{{
+			Original:      original,
+			Key:           filename,
+			URL:           url,
+			CanonicalURL:  canonicalURL(url),
+			AliasURL:      aliasURL,
+			AliasError:    aliasError,
+			Deduplicated:  deduplicated,
+			Size:          storedSize,
+			ContentType:   sniffed,
+			Width:         header.Width,
+			Height:        header.Height,
+			Format:        imageFormat,
+			OriginalSize:  r.ContentLength,
+			StoredSize:    storedSize,
+			DurationMs:    elapsed.Milliseconds(),
+			ThroughputBps: throughput(storedSize, elapsed),
+			MD5:           digests.MD5Hex,
+			ImageMetadata: imageMeta,
+			Partial:       len(budget.skipped) > 0,
+			SkippedSteps:  budget.skipped,
+		}}
+		// fallbackFilename already replaced a mismatched extension, so compare
+		// against the name the client sent.
+		if verbose {
+			resp.Files[0].RelativeURL, resp.Files[0].AbsoluteURL = "/"+filename, url
+		}
+		if filepath.Ext(original) != "" && detectContentType(original) != sniffed {
+			resp.Files[0].DeclaredType, resp.Files[0].DetectedType = detectContentType(original), sniffed
+		}
+	}
+	if receiptsEnabled() {
+		files := []ReceiptFile{{Key: filename, Size: storedSize, SHA256: digests.SHA256Hex}}
+		if resp.Receipt, err = signReceipt(label, files); err != nil {
+			log.Println("Failed to sign receipt:", err)
+		}
+	}
+	notifyUpload(r, label, []WebhookFile{{Key: filename, URL: url, Size: storedSize, ContentType: sniffed, Deduplicated: deduplicated}})
+	w.Header().Set("Location", url)
+	sendResponse(w, resp)
+}
+
+// fallbackFilename fills in whatever the client left out: the configured
+// default base name when there is no filename, and an extension derived from
+// the detected content type when the given one is missing or wrong.
+func fallbackFilename(given, contentType string) (string, error) {
+	given = filepath.Base(given)
+	ext := filepath.Ext(given)
+	base := strings.TrimSuffix(given, ext)
+	if base == "" || base == "." || base == string(filepath.Separator) {
+		base = defaultBaseName
+	}
+	if ext != "" && detectContentType(given) == contentType {
+		return base + ext, nil
+	}
+
+	ext, ok := sniffedExtensions[contentType]
+	if !ok {
+		exts, _ := mime.ExtensionsByType(contentType)
+		if len(exts) == 0 {
+			return "", fmt.Errorf("Cannot determine file extension for type %s", contentType)
+		}
+		ext = exts[0]
+	}
+	return base + ext, nil
+}
@@ -0,0 +1,115 @@
+package uploader
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/joho/godotenv"
+)
+
+var disabledTypes atomic.Pointer[map[string]bool]
+
+// loadDisabledTypes parses DISABLED_TYPES (MIME types or extensions) and
+// swaps the whole set in one store so uploads never see a half-built map.
+func loadDisabledTypes() {
+	set := map[string]bool{}
+	for _, t := range envList("DISABLED_TYPES") {
+		t = strings.ToLower(t)
+		if strings.HasPrefix(t, ".") {
+			t = detectContentType("file" + t)
+		}
+		set[t] = true
+	}
+	disabledTypes.Store(&set)
+}
+
+func isTypeDisabled(contentType string) bool {
+	set := disabledTypes.Load()
+	return set != nil && (*set)[contentType]
+}
+
+// reloadable are the settings a reload applies again.
+var reloadable = []string{"DISABLED_TYPES"}
+
+// startEnv holds the reloadable variables the process was started with,
+// read before main loads .env into the environment.
+var startEnv = map[string]string{}
+
+func init() {
+	for _, name := range reloadable {
+		if v, ok := os.LookupEnv(name); ok {
+			startEnv[name] = v
+		}
+	}
+}
+
+// fromEnvFile holds the reloadable values the environment got from .env,
+// and shadowed the Config.Settings values they replaced. A reload that finds
+// one gone from .env puts back what was there before.
+var fromEnvFile, shadowed = map[string]string{}, map[string]string{}
+
+func watchReload(s *Server) {
+	if file, err := godotenv.Read(); err == nil {
+		for _, name := range reloadable {
+			if v, ok := file[name]; ok && os.Getenv(name) == v {
+				fromEnvFile[name] = v
+			}
+		}
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	s.background.Go(func() {
+		defer signal.Stop(sig)
+		for {
+			select {
+			case <-sig:
+				reloadConfig()
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+func reloadConfig() {
+	file, err := godotenv.Read()
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("Config reload: failed to read .env:", err)
+		return
+	}
+	for name, v := range file {
+		os.Setenv(name, v)
+	}
+	// Once .env sets a reloadable setting, it wins over Config.Settings.
+	// Once it no longer does, the setting goes back to the process
+	// environment and Config.Settings, or to its default.
+	for _, name := range reloadable {
+		if v, ok := file[name]; ok {
+			fromEnvFile[name] = v
+			if v, ok := settings[name]; ok {
+				shadowed[name] = v
+				delete(settings, name)
+			}
+			continue
+		}
+		if v, ok := fromEnvFile[name]; ok && os.Getenv(name) == v {
+			if start, ok := startEnv[name]; ok {
+				os.Setenv(name, start)
+			} else {
+				os.Unsetenv(name)
+			}
+		}
+		delete(fromEnvFile, name)
+		if v, ok := shadowed[name]; ok {
+			settings[name] = v
+			delete(shadowed, name)
+		}
+	}
+	loadDisabledTypes()
+	reloadCertificates()
+	log.Println("🔄 Config reloaded (DISABLED_TYPES:", getenv("DISABLED_TYPES")+")")
+}
@@ -0,0 +1,89 @@
+package uploader
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+var r2MaxAttempts = retry.DefaultMaxAttempts
+var maxRetryAfter = 20 * time.Second
+
+func initRetry() {
+	r2MaxAttempts = envInt("R2_MAX_ATTEMPTS", r2MaxAttempts)
+	maxRetryAfter = envDuration("R2_MAX_RETRY_AFTER", maxRetryAfter)
+}
+
+// newRetryer is the SDK's standard retryer with a backoff that honors
+// Retry-After. Both R2 and the fallback backend use it.
+func newRetryer() aws.Retryer {
+	return retry.NewStandard(func(o *retry.StandardOptions) {
+		o.MaxAttempts = r2MaxAttempts
+		o.Backoff = retryAfterBackoff{jitter: retry.NewExponentialJitterBackoff(o.MaxBackoff)}
+	})
+}
+
+// retryAfterBackoff waits as long as a throttling or 503 response asks,
+// capped at maxRetryAfter so a large hint can't hold an upload past its
+// deadline, and falls back to exponential jitter otherwise.
+type retryAfterBackoff struct {
+	jitter retry.BackoffDelayer
+}
+
+func (b retryAfterBackoff) BackoffDelay(attempt int, err error) (time.Duration, error) {
+	delay, backoffErr := b.jitter.BackoffDelay(attempt, err)
+	resp := errorResponse(err)
+	if resp == nil {
+		return delay, backoffErr
+	}
+	if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+		delay = min(wait, maxRetryAfter)
+	}
+	log.Printf("Storage returned %d on attempt %d, retrying in %s", resp.StatusCode, attempt, delay.Round(time.Millisecond))
+	return delay, backoffErr
+}
+
+// parseRetryAfter accepts both forms of the header: delay seconds and an
+// HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
+
+func errorResponse(err error) *http.Response {
+	var respErr *awshttp.ResponseError
+	if !errors.As(err, &respErr) || respErr.Response == nil {
+		return nil
+	}
+	return respErr.Response.Response
+}
+
+// logStorageError records the status behind a failed storage call. The SDK
+// follows 307 and 308, which keep the method; any redirect that still comes
+// back means the endpoint or bucket region is wrong, since following it
+// would break the request signature.
+func logStorageError(op, key string, err error) {
+	resp := errorResponse(err)
+	switch {
+	case resp == nil:
+		log.Println(op, "failed for", key+":", err)
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		log.Printf("%s for %s was redirected (%d) to %q; check the endpoint and bucket configuration", op, key, resp.StatusCode, resp.Header.Get("Location"))
+	default:
+		log.Printf("%s failed for %s with status %d: %v", op, key, resp.StatusCode, err)
+	}
+}
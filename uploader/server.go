@@ -0,0 +1,38 @@
+package uploader
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// Server timeouts keep slow or idle clients from holding connections open.
+// ReadTimeout covers the whole request body and WriteTimeout the whole
+// handler, so both must leave room for the largest upload.
+var (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 5 * time.Minute
+	writeTimeout      = 6 * time.Minute
+	idleTimeout       = 2 * time.Minute
+)
+
+func initServerTimeouts() {
+	readHeaderTimeout = envDuration("READ_HEADER_TIMEOUT", readHeaderTimeout)
+	readTimeout = envDuration("READ_TIMEOUT", readTimeout)
+	writeTimeout = envDuration("WRITE_TIMEOUT", writeTimeout)
+	idleTimeout = envDuration("IDLE_TIMEOUT", idleTimeout)
+	if writeTimeout > 0 && (batchTimeout == 0 || batchTimeout >= writeTimeout) {
+		log.Println("⚠️  WRITE_TIMEOUT is not longer than BATCH_TIMEOUT: slow batches will be cut off before their response is sent")
+	}
+}
+
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+}
@@ -0,0 +1,1046 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memStorage keeps objects in memory. Puts fail with putErr when it is set.
+type memStorage struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	putErr  error
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{objects: map[string][]byte{}}
+}
+
+func (m *memStorage) keys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.objects))
+	for key := range m.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *memStorage) Put(ctx context.Context, key string, body io.Reader, size int64, opts UploadOptions) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.putErr != nil {
+		return m.putErr
+	}
+	m.objects[key] = data
+	return nil
+}
+
+func (m *memStorage) Get(ctx context.Context, key string) (io.ReadCloser, StoredObject, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[key]
+	if !ok {
+		return nil, StoredObject{}, fmt.Errorf("get %s: %w", key, fs.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(data)), StoredObject{Key: key, Size: int64(len(data))}, nil
+}
+
+func (m *memStorage) Head(ctx context.Context, key string) (StoredObject, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[key]
+	if !ok {
+		return StoredObject{}, fmt.Errorf("head %s: %w", key, fs.ErrNotExist)
+	}
+	return StoredObject{Key: key, Size: int64(len(data))}, nil
+}
+
+func (m *memStorage) Copy(ctx context.Context, from, to string, headers *ObjectHeaders) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[from]
+	if !ok {
+		return fmt.Errorf("copy %s: %w", from, fs.ErrNotExist)
+	}
+	m.objects[to] = data
+	return nil
+}
+
+func (m *memStorage) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *memStorage) DeleteBatch(ctx context.Context, keys []string) []error {
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		errs[i] = m.Delete(ctx, key)
+	}
+	return errs
+}
+
+func (m *memStorage) List(ctx context.Context, prefix, cursor string, limit int) (ListPage, error) {
+	var page ListPage
+	for _, key := range m.keys() {
+		if !strings.HasPrefix(key, prefix) || key <= cursor {
+			continue
+		}
+		if len(page.Objects) == limit {
+			page.NextCursor = page.Objects[limit-1].Key
+			break
+		}
+		obj, _ := m.Head(ctx, key)
+		page.Objects = append(page.Objects, obj)
+	}
+	return page, nil
+}
+
+func (m *memStorage) Scan(ctx context.Context, prefix string, fn func(StoredObject)) error {
+	for _, key := range m.keys() {
+		if obj, err := m.Head(ctx, key); err == nil && strings.HasPrefix(key, prefix) {
+			fn(obj)
+		}
+	}
+	return nil
+}
+
+func (m *memStorage) PresignPut(ctx context.Context, key, contentType string, size int64, expiry time.Duration) (PresignedPut, error) {
+	return PresignedPut{}, errPresignUnsupported
+}
+
+func (m *memStorage) PublicURL(ctx context.Context, key string) (string, error) {
+	return "https://cdn.example.com/" + key, nil
+}
+
+func (m *memStorage) Ping(ctx context.Context) error {
+	return nil
+}
+
+const testAPIKey = "test-key"
+
+func newTestServer(t *testing.T, cfg Config) (*Server, *memStorage) {
+	t.Helper()
+	mem := newMemStorage()
+	cfg.APIKey = testAPIKey
+	cfg.Storage, cfg.PublicURL = mem, "https://cdn.example.com"
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shutdownServer(t, srv) })
+	return srv, mem
+}
+
+func shutdownServer(t *testing.T, srv *Server) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal("shutdown:", err)
+	}
+}
+
+func serve(t *testing.T, h http.Handler, method, target string, body io.Reader, contentType string) (*httptest.ResponseRecorder, ApiResponse) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, body)
+	req.Header.Set("X-API-Key", testAPIKey)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var resp ApiResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s %s: decoding response %q: %v", method, target, rec.Body.String(), err)
+	}
+	return rec, resp
+}
+
+func TestNewConfigErrors(t *testing.T) {
+	t.Setenv("API_KEY", "")
+	for name, cfg := range map[string]Config{
+		"API_KEY":            {Storage: newMemStorage()},
+		"LOG_FORMAT":         {APIKey: testAPIKey, Storage: newMemStorage(), Settings: map[string]string{"LOG_FORMAT": "xml"}},
+		"MAX_IMAGE_WIDTH":    {APIKey: testAPIKey, Storage: newMemStorage(), Settings: map[string]string{"MAX_IMAGE_WIDTH": "-1"}},
+		"THUMBNAIL_FORMAT":   {APIKey: testAPIKey, Storage: newMemStorage(), Settings: map[string]string{"THUMBNAIL_FORMAT": "webp"}},
+		"MAX_VARIANTS":       {APIKey: testAPIKey, Storage: newMemStorage(), Settings: map[string]string{"MAX_DERIVATIVES": "2", "MAX_VARIANTS": "3"}},
+		"TARGET_QUALITY_MIN": {APIKey: testAPIKey, Storage: newMemStorage(), Settings: map[string]string{"TARGET_QUALITY_MIN": "90", "TARGET_QUALITY_MAX": "80"}},
+		"KEY_TEMPLATE":       {APIKey: testAPIKey, Storage: newMemStorage(), Settings: map[string]string{"KEY_STRATEGY": "template", "KEY_TEMPLATE": "{uuid|truncate:2}"}},
+	} {
+		if _, err := New(cfg); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("%s: New error = %v, want one naming %s", name, err, name)
+		}
+	}
+}
+
+func TestNewZeroDisablesLimits(t *testing.T) {
+	srv, _ := newTestServer(t, Config{Settings: map[string]string{
+		"MIN_FILE_SIZE_BYTES":       "0",
+		"MAX_IMAGE_WIDTH":           "0",
+		"MAX_IMAGE_HEIGHT":          "0",
+		"MAX_CONCURRENT_PER_IP":     "0",
+		"BREAKER_FAILURE_THRESHOLD": "0",
+		"MAX_VARIANTS":              "0",
+	}})
+
+	body, contentType := multipartPNGs(t, 1)
+	if rec, _ := serve(t, srv, http.MethodPost, "/upload", body, contentType); rec.Code != 200 {
+		t.Errorf("upload: status %d, want 200", rec.Code)
+	}
+	body, contentType = multipartPNGs(t, 1)
+	if rec, _ := serve(t, srv, http.MethodPost, "/upload?variants=thumb:10", body, contentType); rec.Code != 400 {
+		t.Errorf("variants with MAX_VARIANTS=0: status %d, want 400", rec.Code)
+	}
+}
+
+func TestServerRequiresAPIKey(t *testing.T) {
+	srv, _ := newTestServer(t, Config{})
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != 401 {
+		t.Errorf("without a key: status %d, want 401", rec.Code)
+	}
+	if rec, _ := serve(t, srv, http.MethodGet, "/", nil, ""); rec.Code != 200 {
+		t.Errorf("with the key: status %d, want 200", rec.Code)
+	}
+}
+
+func TestServerMountedUnderPrefix(t *testing.T) {
+	srv, mem := newTestServer(t, Config{})
+	mux := http.NewServeMux()
+	mux.Handle("/media/", http.StripPrefix("/media", srv))
+
+	body, contentType := multipartPNGs(t, 2)
+	rec, resp := serve(t, mux, http.MethodPost, "/media/upload", body, contentType)
+	if rec.Code != 200 || len(resp.URLs) != 2 {
+		t.Fatalf("upload: status %d, urls %v, want 200 and 2 URLs", rec.Code, resp.URLs)
+	}
+	keys := mem.keys()
+	if len(keys) != 2 {
+		t.Fatalf("storage holds %v, want 2 objects", keys)
+	}
+	for _, u := range resp.URLs {
+		if key := strings.TrimPrefix(u, "https://cdn.example.com/"); !strings.HasPrefix(key, uploadPrefix) || mem.objects[key] == nil {
+			t.Errorf("url %s does not point at a stored object", u)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/media/images", nil)
+	req.Header.Set("X-API-Key", testAPIKey)
+	list := httptest.NewRecorder()
+	mux.ServeHTTP(list, req)
+	var page ListImagesResponse
+	if err := json.Unmarshal(list.Body.Bytes(), &page); err != nil || len(page.Objects) != 2 {
+		t.Fatalf("list: %s, want 2 objects", list.Body.String())
+	}
+
+	if rec, _ := serve(t, mux, http.MethodDelete, "/media/images/"+keys[0], nil, ""); rec.Code != 200 {
+		t.Errorf("delete: status %d, want 200", rec.Code)
+	}
+	if rec, _ := serve(t, mux, http.MethodDelete, "/media/images/"+keys[0], nil, ""); rec.Code != 404 {
+		t.Errorf("second delete: status %d, want 404", rec.Code)
+	}
+	if left := mem.keys(); len(left) != 1 || left[0] != keys[1] {
+		t.Errorf("storage holds %v, want [%s]", left, keys[1])
+	}
+}
+
+func TestServerConfigLimits(t *testing.T) {
+	srv, mem := newTestServer(t, Config{MaxFiles: 1})
+
+	body, contentType := multipartPNGs(t, 2)
+	rec, _ := serve(t, srv, http.MethodPost, "/upload", body, contentType)
+	if rec.Code != 400 {
+		t.Errorf("2 files with MaxFiles 1: status %d, want 400", rec.Code)
+	}
+	if keys := mem.keys(); len(keys) != 0 {
+		t.Errorf("storage holds %v, want nothing", keys)
+	}
+}
+
+func TestServerUploadStorageError(t *testing.T) {
+	srv, mem := newTestServer(t, Config{})
+	mem.putErr = errors.New("bucket unavailable")
+
+	body, contentType := multipartPNGs(t, 1)
+	rec, resp := serve(t, srv, http.MethodPost, "/upload", body, contentType)
+	if rec.Code < 500 || len(resp.URLs) != 0 {
+		t.Errorf("status %d, urls %v, want a 5xx and no URLs", rec.Code, resp.URLs)
+	}
+	if len(resp.Retry) != 1 || !resp.Retry[0].Retryable {
+		t.Errorf("retry = %+v, want the file listed as retryable", resp.Retry)
+	}
+}
+
+func TestNewOneServerAtATime(t *testing.T) {
+	first, err := New(Config{APIKey: testAPIKey, Storage: newMemStorage(), MaxFiles: 1, Settings: map[string]string{"TRUSTED_PROXIES": "10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(Config{APIKey: testAPIKey, Storage: newMemStorage()}); !errors.Is(err, errServerActive) {
+		t.Fatalf("second New while the first runs: error %v, want errServerActive", err)
+	}
+	shutdownServer(t, first)
+	shutdownServer(t, first) // a second Shutdown is a no-op
+
+	if maxFiles != 5 || trustedProxies != nil {
+		t.Errorf("after Shutdown: maxFiles %d, trusted proxies %v, want the defaults", maxFiles, trustedProxies)
+	}
+	srv, _ := newTestServer(t, Config{Settings: map[string]string{"TRUSTED_PROXIES": "10.0.0.0/8"}})
+	body, contentType := multipartPNGs(t, 2)
+	if rec, _ := serve(t, srv, http.MethodPost, "/upload", body, contentType); rec.Code != 200 {
+		t.Errorf("2 files after a MaxFiles 1 Server: status %d, want 200", rec.Code)
+	}
+	if len(trustedProxies) != 1 {
+		t.Errorf("trusted proxies %v, want just the one configured", trustedProxies)
+	}
+}
+
+// largePNG is an uncompressed PNG of about 1.6MB, past a 1MB form memory or
+// file size limit.
+func largePNG(t *testing.T) []byte {
+	t.Helper()
+	var img bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.NoCompression}
+	if err := enc.Encode(&img, image.NewRGBA(image.Rect(0, 0, 640, 640))); err != nil {
+		t.Fatal(err)
+	}
+	return img.Bytes()
+}
+
+func TestServerOversizedPartNotSpooled(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	srv, mem := newTestServer(t, Config{MaxFileSizeMB: 1, Settings: map[string]string{"FORM_MEMORY_MB": "1"}})
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("images", "large.png")
+	part.Write(largePNG(t))
+	var img bytes.Buffer
+	png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	part, _ = mw.CreateFormFile("images", "small.png")
+	part.Write(img.Bytes())
+	mw.Close()
+
+	rec, resp := serve(t, srv, http.MethodPost, "/upload", &body, mw.FormDataContentType())
+	if rec.Code != 207 || len(resp.URLs) != 1 {
+		t.Fatalf("status %d, urls %v, want the small file stored", rec.Code, resp.URLs)
+	}
+	if len(resp.Retry) != 1 || resp.Retry[0].Reason != reasonTooLarge {
+		t.Errorf("retry = %+v, want large.png as %s", resp.Retry, reasonTooLarge)
+	}
+	if keys := mem.keys(); len(keys) != 1 {
+		t.Errorf("storage holds %v, want only the small file", keys)
+	}
+	if left, _ := os.ReadDir(tmp); len(left) != 0 {
+		t.Errorf("temp files left behind: %v", left)
+	}
+}
+
+func TestServerAsyncUploadSpilledToDisk(t *testing.T) {
+	srv, mem := newTestServer(t, Config{Settings: map[string]string{"FORM_MEMORY_MB": "1"}})
+	// A real server, since it's net/http that removes a form's temp files
+	// when the handler returns.
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	img := largePNG(t)
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("images", "large.png")
+	part.Write(img)
+	mw.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/upload?async=true", &body)
+	req.Header.Set("X-API-Key", testAPIKey)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accepted JobAccepted
+	json.NewDecoder(res.Body).Decode(&accepted)
+	res.Body.Close()
+	if res.StatusCode != 202 || accepted.JobID == "" {
+		t.Fatalf("upload: status %d, job %q, want 202 and a job ID", res.StatusCode, accepted.JobID)
+	}
+
+	var job JobResponse
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+accepted.StatusURL, nil)
+		req.Header.Set("X-API-Key", testAPIKey)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewDecoder(res.Body).Decode(&job)
+		res.Body.Close()
+		if job.State == jobDone || job.State == jobFailed || time.Now().After(deadline) {
+			break
+		}
+	}
+	if job.State != jobDone {
+		t.Fatalf("job state %q, files %+v, want done", job.State, job.Files)
+	}
+	if keys := mem.keys(); len(keys) != 1 || len(mem.objects[keys[0]]) != len(img) {
+		t.Errorf("storage holds %v, want the %d-byte image", keys, len(img))
+	}
+}
+
+// webhookReceiver answers every delivery with status and passes the
+// requests it got on.
+func webhookReceiver(t *testing.T, status int) (*httptest.Server, chan *http.Request, chan []byte) {
+	t.Helper()
+	reqs, bodies := make(chan *http.Request, 10), make(chan []byte, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		reqs <- r
+		bodies <- body
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, reqs, bodies
+}
+
+func TestServerWebhookSignedAndNotRetriedOn4xx(t *testing.T) {
+	const secret = "0123456789abcdef0123456789abcdef"
+	ts, reqs, bodies := webhookReceiver(t, 400)
+	srv, _ := newTestServer(t, Config{Settings: map[string]string{"WEBHOOK_URL": ts.URL, "WEBHOOK_SECRET": secret}})
+
+	body, contentType := multipartPNGs(t, 1)
+	if rec, _ := serve(t, srv, http.MethodPost, "/upload", body, contentType); rec.Code != 200 {
+		t.Fatalf("upload: status %d, want 200", rec.Code)
+	}
+	var req *http.Request
+	select {
+	case req = <-reqs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook delivered")
+	}
+	payload := <-bodies
+
+	stamp := req.Header.Get("X-Webhook-Timestamp")
+	sent, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil || time.Since(time.Unix(sent, 0)).Abs() > time.Minute {
+		t.Errorf("timestamp %q, want Unix seconds of about now", stamp)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(stamp + "."))
+	mac.Write(payload)
+	if got, want := req.Header.Get("X-Webhook-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("signature %q, want %q", got, want)
+	}
+	var event webhookPayload
+	if err := json.Unmarshal(payload, &event); err != nil || event.Event != "upload.completed" || len(event.Files) != 1 {
+		t.Errorf("payload %s, want an upload.completed event for 1 file", payload)
+	}
+
+	shutdownServer(t, srv)
+	if n := len(reqs); n != 0 {
+		t.Errorf("%d more deliveries after a 400, want none", n)
+	}
+}
+
+func TestServerShutdownCutsWebhookBackoff(t *testing.T) {
+	ts, reqs, _ := webhookReceiver(t, 503)
+	srv, _ := newTestServer(t, Config{Settings: map[string]string{"WEBHOOK_URL": ts.URL}})
+
+	body, contentType := multipartPNGs(t, 1)
+	serve(t, srv, http.MethodPost, "/upload", body, contentType)
+	select {
+	case <-reqs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook delivered")
+	}
+
+	// The retries would take 15s in all; a timed-out Shutdown gives up on them.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shutdown during backoff: error %v, want the deadline", err)
+	}
+	shutdownServer(t, srv)
+}
+
+func TestServerVariantsDecodeLimit(t *testing.T) {
+	srv, mem := newTestServer(t, Config{Settings: map[string]string{"MAX_DECODE_PIXELS": "10"}})
+
+	body, contentType := multipartPNGs(t, 1)
+	rec, resp := serve(t, srv, http.MethodPost, "/upload?variants=thumb:2", body, contentType)
+	if rec.Code != 200 || len(resp.Files) != 1 {
+		t.Fatalf("upload: status %d, files %+v, want 200 and 1 file", rec.Code, resp.Files)
+	}
+	if got := resp.Files[0].VariantError; got != errDecodePixels.Error() {
+		t.Errorf("variant error %q, want %q for a 16-pixel image over a 10-pixel limit", got, errDecodePixels)
+	}
+	if keys := mem.keys(); len(keys) != 1 {
+		t.Errorf("storage holds %v, want only the original", keys)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// A 3x2 image whose only red pixel is at the top left.
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	src.Set(0, 0, color.RGBA{R: 255, A: 255})
+	for orientation, want := range map[int]image.Point{
+		1: {0, 0}, 2: {2, 0}, 3: {2, 1}, 4: {0, 1},
+		5: {0, 0}, 6: {1, 0}, 7: {1, 2}, 8: {0, 2},
+	} {
+		dst := orient(src, orientation)
+		wantSize := image.Pt(3, 2)
+		if orientation >= 5 {
+			wantSize = image.Pt(2, 3)
+		}
+		if dst.Bounds().Size() != wantSize {
+			t.Errorf("orientation %d: size %v, want %v", orientation, dst.Bounds().Size(), wantSize)
+			continue
+		}
+		if r, _, _, _ := dst.At(want.X, want.Y).RGBA(); r == 0 {
+			t.Errorf("orientation %d: red pixel not at %v", orientation, want)
+		}
+	}
+}
+
+func TestServerTenantNestedInSharedPrefix(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tenants.json")
+	tenantsJSON := `[{"name": "mobile", "key": "mobile-key", "prefix": "uploads/mobile/"}]`
+	if err := os.WriteFile(file, []byte(tenantsJSON), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	srv, mem := newTestServer(t, Config{Settings: map[string]string{"API_KEYS_FILE": file}})
+
+	body, contentType := multipartPNGs(t, 1)
+	req := httptest.NewRequest(http.MethodPost, "/upload?files=true", body)
+	req.Header.Set("X-API-Key", "mobile-key")
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	var resp ApiResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != 200 || len(resp.Files) != 1 || !strings.HasPrefix(resp.Files[0].Key, "uploads/mobile/") {
+		t.Fatalf("tenant upload: status %d, files %+v, want a key under uploads/mobile/", rec.Code, resp.Files)
+	}
+	key := resp.Files[0].Key
+
+	// The default key uses the shared uploads/, which holds the tenant's prefix.
+	if rec, _ := serve(t, srv, http.MethodDelete, "/images/"+key, nil, ""); rec.Code != 400 {
+		t.Errorf("shared key deleting a tenant object: status %d, want 400", rec.Code)
+	}
+	if rec, _ := serve(t, srv, http.MethodDelete, "/delete?key="+key, nil, ""); rec.Code != 400 {
+		t.Errorf("shared key deleting via /delete: status %d, want 400", rec.Code)
+	}
+	zipBody := strings.NewReader(`{"keys": ["` + key + `"]}`)
+	if rec, _ := serve(t, srv, http.MethodPost, "/download-zip", zipBody, "application/json"); rec.Code != 400 {
+		t.Errorf("shared key zipping a tenant object: status %d, want 400", rec.Code)
+	}
+	if rec, _ := serve(t, srv, http.MethodGet, "/images?prefix=uploads/mobile/", nil, ""); rec.Code != 400 {
+		t.Errorf("shared key listing the tenant prefix: status %d, want 400", rec.Code)
+	}
+	body, contentType = multipartPNGs(t, 1)
+	if rec, _ := serve(t, srv, http.MethodPost, "/upload?folder=mobile", body, contentType); rec.Code != 400 {
+		t.Errorf("shared key uploading into the tenant prefix: status %d, want 400", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/images", nil)
+	req.Header.Set("X-API-Key", testAPIKey)
+	list := httptest.NewRecorder()
+	srv.ServeHTTP(list, req)
+	var page ListImagesResponse
+	if err := json.Unmarshal(list.Body.Bytes(), &page); err != nil || len(page.Objects) != 0 {
+		t.Errorf("shared key listing uploads/: %s, want no objects", list.Body.String())
+	}
+	if keys := mem.keys(); len(keys) != 1 || keys[0] != key {
+		t.Errorf("storage holds %v, want only %s", keys, key)
+	}
+}
+
+func TestServerRateLimitJitter(t *testing.T) {
+	srv, _ := newTestServer(t, Config{Settings: map[string]string{
+		"RATE_LIMIT_RPS":    "0.001",
+		"RATE_LIMIT_BURST":  "1",
+		"RATE_LIMIT_JITTER": "30s",
+	}})
+
+	seen := map[int]bool{}
+	base := 1000 // seconds until the next token at 0.001 requests a second
+	for i := range 20 {
+		rec, _ := serve(t, srv, http.MethodGet, "/", nil, "")
+		if i == 0 {
+			continue
+		}
+		if rec.Code != 429 {
+			t.Fatalf("request %d: status %d, want 429", i, rec.Code)
+		}
+		wait, _ := strconv.Atoi(rec.Header().Get("Retry-After"))
+		if wait < base-1 || wait > base+31 {
+			t.Errorf("Retry-After %d, want %d-%d", wait, base, base+30)
+		}
+		seen[wait] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("every 429 had Retry-After %v, want them spread out", seen)
+	}
+}
+
+func TestServerDedupSummary(t *testing.T) {
+	srv, mem := newTestServer(t, Config{})
+
+	body, contentType := multipartPNGs(t, 1)
+	_, resp := serve(t, srv, http.MethodPost, "/upload", body, contentType)
+	if resp.Dedup != nil {
+		t.Errorf("without dedupe: dedup = %+v, want none", resp.Dedup)
+	}
+
+	body, contentType = multipartPNGs(t, 1)
+	_, resp = serve(t, srv, http.MethodPost, "/upload?dedupe=true", body, contentType)
+	if resp.Dedup == nil || *resp.Dedup != (DedupStats{UploadedNew: 1}) {
+		t.Fatalf("first dedupe upload: dedup = %+v, want 1 new", resp.Dedup)
+	}
+	size := int64(len(mem.objects[resp.Files[0].Key]))
+
+	body, contentType = multipartPNGs(t, 2)
+	_, resp = serve(t, srv, http.MethodPost, "/upload?dedupe=true", body, contentType)
+	if want := (DedupStats{Deduplicated: 2, BytesSaved: 2 * size}); resp.Dedup == nil || *resp.Dedup != want {
+		t.Errorf("repeat upload: dedup = %+v, want %+v", resp.Dedup, want)
+	}
+}
+
+func TestServerUniquenessScope(t *testing.T) {
+	for scope, wantShared := range map[string]bool{"prefix": false, "tenant": true} {
+		t.Run(scope, func(t *testing.T) {
+			srv, mem := newTestServer(t, Config{Settings: map[string]string{"UNIQUENESS_SCOPE": scope}})
+			for _, folder := range []string{"a", "b"} {
+				body, contentType := multipartPNGs(t, 1)
+				_, resp := serve(t, srv, http.MethodPost, "/upload?dedupe=true&folder="+folder, body, contentType)
+				if len(resp.Files) != 1 {
+					t.Fatalf("folder %s: files %+v, want 1", folder, resp.Files)
+				}
+				if folder == "b" && resp.Files[0].Deduplicated != wantShared {
+					t.Errorf("folder b: deduplicated = %v, want %v", resp.Files[0].Deduplicated, wantShared)
+				}
+			}
+			want := 2
+			if wantShared {
+				want = 1
+			}
+			if keys := mem.keys(); len(keys) != want {
+				t.Errorf("storage holds %v, want %d objects", keys, want)
+			}
+		})
+	}
+}
+
+func TestSharpen(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 4))
+	for y := range 4 {
+		for x := range 8 {
+			v := uint8(100)
+			if x >= 4 {
+				v = 200
+			}
+			img.Set(x, y, color.RGBA{R: v, G: v, B: v, A: 255})
+		}
+	}
+	sharpen(img, 1)
+	at := func(x int) color.RGBA { return img.RGBAAt(x, 1) }
+	if at(0).R != 100 || at(7).R != 200 {
+		t.Errorf("flat areas changed: %v, %v", at(0), at(7))
+	}
+	if at(3).R >= 100 || at(4).R <= 200 {
+		t.Errorf("edge pixels %v, %v, want darker and lighter than 100 and 200", at(3), at(4))
+	}
+	if at(3).A != 255 || at(4).A != 255 {
+		t.Error("alpha changed")
+	}
+}
+
+func TestServerThumbnailFormat(t *testing.T) {
+	srv, mem := newTestServer(t, Config{Settings: map[string]string{"THUMBNAIL_FORMAT": "jpeg"}})
+
+	for target, wantExt := range map[string]string{
+		"/upload?variants=thumb:2":             ".jpg",
+		"/upload?variants=thumb:2&convert=png": ".png",
+	} {
+		body, contentType := multipartPNGs(t, 1)
+		_, resp := serve(t, srv, http.MethodPost, target, body, contentType)
+		if len(resp.Files) != 1 || resp.Files[0].Variants["thumb"] == "" {
+			t.Fatalf("%s: files %+v, want a thumb variant", target, resp.Files)
+		}
+		key := strings.TrimPrefix(resp.Files[0].Variants["thumb"], "https://cdn.example.com/")
+		if filepath.Ext(key) != wantExt {
+			t.Errorf("%s: variant key %s, want a %s extension", target, key, wantExt)
+		}
+		if got := http.DetectContentType(mem.objects[key]); got != detectContentType(key) {
+			t.Errorf("%s: variant %s holds %s", target, key, got)
+		}
+	}
+}
+
+func TestGuessOrientation(t *testing.T) {
+	// A page turned on its side: lines of text run top to bottom, and the
+	// bright top margin ends up on one side.
+	sideways := func(marginLeft bool) image.Image {
+		img := image.NewGray(image.Rect(0, 0, 120, 80))
+		for y := range 80 {
+			for x := range 120 {
+				v := uint8(200)
+				if x%12 < 4 {
+					v = 40
+				}
+				if (marginLeft && x < 30) || (!marginLeft && x >= 90) {
+					v = 255
+				}
+				img.SetGray(x, y, color.Gray{Y: v})
+			}
+		}
+		return img
+	}
+	upright := image.NewGray(image.Rect(0, 0, 120, 80))
+	for y := range 80 {
+		for x := range 120 {
+			upright.SetGray(x, y, color.Gray{Y: uint8(255 - 3*y)})
+		}
+	}
+
+	for name, tc := range map[string]struct {
+		img  image.Image
+		want int
+	}{
+		"top on the left":  {sideways(true), 6},
+		"top on the right": {sideways(false), 8},
+		"upright":          {upright, 1},
+		"portrait frame":   {orient(sideways(true), 6), 1},
+		"flat":             {image.NewGray(image.Rect(0, 0, 120, 80)), 1},
+	} {
+		if got := guessOrientation(tc.img); got != tc.want {
+			t.Errorf("%s: orientation %d, want %d", name, got, tc.want)
+		}
+	}
+}
+
+func TestServerDerivativeCap(t *testing.T) {
+	srv, mem := newTestServer(t, Config{Settings: map[string]string{"MAX_DERIVATIVES": "2", "MAX_VARIANTS": "2", "ALIAS_UPLOADS": "true"}})
+
+	body, contentType := multipartPNGs(t, 1)
+	_, resp := serve(t, srv, http.MethodPost, "/upload?logical_id=avatar&variants=small:2,large:3", body, contentType)
+	if len(resp.Files) != 1 {
+		t.Fatalf("files %+v, want 1", resp.Files)
+	}
+	f := resp.Files[0]
+	if f.AliasURL == "" || f.Variants["small"] == "" || f.Variants["large"] != "" {
+		t.Errorf("alias %q, variants %v, want the alias and only the small variant", f.AliasURL, f.Variants)
+	}
+	if !strings.Contains(f.VariantError, "large") {
+		t.Errorf("variant error %q, want it to name large", f.VariantError)
+	}
+	if keys := mem.keys(); len(keys) != 3 {
+		t.Errorf("storage holds %v, want the original and 2 derivatives", keys)
+	}
+}
+
+func TestReloadDropsRemovedSettings(t *testing.T) {
+	newTestServer(t, Config{Settings: map[string]string{"DISABLED_TYPES": "image/jpeg"}})
+	t.Chdir(t.TempDir())
+	// Restored afterwards, since reloads set them.
+	t.Setenv("DISABLED_TYPES", "")
+	t.Setenv("RELOAD_TEST", "")
+
+	reload := func(env string) {
+		t.Helper()
+		if err := os.WriteFile(".env", []byte(env), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		reloadConfig()
+	}
+	check := func(step string, png, jpeg bool) {
+		t.Helper()
+		if isTypeDisabled("image/png") != png || isTypeDisabled("image/jpeg") != jpeg {
+			t.Errorf("%s: png disabled %v, jpeg disabled %v, want %v and %v", step, isTypeDisabled("image/png"), isTypeDisabled("image/jpeg"), png, jpeg)
+		}
+	}
+
+	reload("DISABLED_TYPES=image/png\n")
+	check(".env sets DISABLED_TYPES", true, false)
+	reload("RELOAD_TEST=1\n")
+	check(".env no longer sets it", false, true)
+	if _, ok := os.LookupEnv("DISABLED_TYPES"); ok {
+		t.Error("DISABLED_TYPES still set in the environment")
+	}
+}
+
+// scanGate holds Scan calls until release is closed.
+type scanGate struct {
+	*memStorage
+	scans   atomic.Int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (g *scanGate) Scan(ctx context.Context, prefix string, fn func(StoredObject)) error {
+	g.scans.Add(1)
+	g.started <- struct{}{}
+	<-g.release
+	return g.memStorage.Scan(ctx, prefix, fn)
+}
+
+func TestLargestObjectsScanOutsideLock(t *testing.T) {
+	gate := &scanGate{memStorage: newMemStorage(), started: make(chan struct{}, 10), release: make(chan struct{})}
+	gate.objects["uploads/big.png"] = make([]byte, 100)
+	srv, err := New(Config{APIKey: testAPIKey, Storage: gate, PublicURL: "https://cdn.example.com", Settings: map[string]string{"ADMIN_API_KEY": "admin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shutdownServer(t, srv) })
+
+	get := func(ctx context.Context) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		largestObjectsHandler(rec, httptest.NewRequest(http.MethodGet, "/stats/largest", nil).WithContext(ctx))
+		return rec
+	}
+	var wg sync.WaitGroup
+	codes := make([]int, 4)
+	wg.Go(func() { codes[0] = get(context.Background()).Code })
+	<-gate.started
+	for i := 1; i < len(codes); i++ {
+		wg.Go(func() { codes[i] = get(context.Background()).Code })
+	}
+
+	// A client that gives up isn't stuck behind the running scan.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan int)
+	go func() { done <- get(ctx).Code }()
+	select {
+	case code := <-done:
+		if code != 502 {
+			t.Errorf("canceled request: status %d, want 502", code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("canceled request waited for the scan to finish")
+	}
+
+	close(gate.release)
+	wg.Wait()
+	for i, code := range codes {
+		if code != 200 {
+			t.Errorf("request %d: status %d, want 200", i, code)
+		}
+	}
+	if n := gate.scans.Load(); n != 1 {
+		t.Errorf("%d scans, want 1 shared by every request", n)
+	}
+	var resp LargestObjectsResponse
+	json.Unmarshal(get(context.Background()).Body.Bytes(), &resp)
+	if !resp.Cached || len(resp.Objects) != 1 {
+		t.Errorf("after the scan: cached %v, objects %+v, want the cached big.png", resp.Cached, resp.Objects)
+	}
+}
+
+func TestServerCamelCaseKeepsVariantNames(t *testing.T) {
+	srv, _ := newTestServer(t, Config{Settings: map[string]string{"RESPONSE_FIELD_CASE": "camel"}})
+
+	body, contentType := multipartPNGs(t, 1)
+	req := httptest.NewRequest(http.MethodPost, "/upload?variants=big_thumb:2", body)
+	req.Header.Set("X-API-Key", testAPIKey)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	var resp struct {
+		Files []struct {
+			OriginalSize int64             `json:"originalSize"`
+			Variants     map[string]string `json:"variants"`
+		} `json:"files"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || len(resp.Files) != 1 {
+		t.Fatalf("response %s: %v", rec.Body, err)
+	}
+	f := resp.Files[0]
+	if f.OriginalSize == 0 {
+		t.Errorf("response %s: fields not camelCase", rec.Body)
+	}
+	if f.Variants["big_thumb"] == "" {
+		t.Errorf("variants %v, want big_thumb as requested", f.Variants)
+	}
+}
+
+func TestServerQuotaSkipsOversizedFiles(t *testing.T) {
+	srv, mem := newTestServer(t, Config{Settings: map[string]string{
+		"MAX_FILE_SIZE_MB": "1",
+		"KEY_QUOTAS":       "default:10000",
+		"KEY_DAILY_QUOTAS": "default:10000",
+	}})
+
+	var img bytes.Buffer
+	png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("images", "small.png")
+	part.Write(img.Bytes())
+	part, _ = mw.CreateFormFile("images", "huge.png")
+	part.Write(append(img.Bytes(), make([]byte, 2<<20)...))
+	mw.Close()
+
+	rec, resp := serve(t, srv, http.MethodPost, "/upload", &body, mw.FormDataContentType())
+	if len(resp.URLs) != 1 || len(resp.Failed) != 1 {
+		t.Fatalf("status %d, urls %v, failed %+v, want small.png stored and huge.png failed", rec.Code, resp.URLs, resp.Failed)
+	}
+	if keys := mem.keys(); len(keys) != 1 {
+		t.Errorf("storage holds %v, want only small.png", keys)
+	}
+}
+
+func TestAdminMiddleware(t *testing.T) {
+	t.Cleanup(func() { adminKey = "" })
+	ok := adminMiddleware(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(200) })
+	for _, tc := range []struct {
+		adminKey, header string
+		want             int
+	}{
+		{"", "", 401},
+		{"", "anything", 401},
+		{"admin-key", "", 401},
+		{"admin-key", "admin-kez", 401},
+		{"admin-key", "admin-key-2", 401},
+		{"admin-key", "admin-key", 200},
+	} {
+		adminKey = tc.adminKey
+		req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+		if tc.header != "" {
+			req.Header.Set("X-API-Key", tc.header)
+		}
+		rec := httptest.NewRecorder()
+		ok(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("ADMIN_API_KEY %q, X-API-Key %q: status %d, want %d", tc.adminKey, tc.header, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestServerListImagesResponseCap(t *testing.T) {
+	srv, mem := newTestServer(t, Config{Settings: map[string]string{"MAX_RESPONSE_BYTES": "250"}})
+	for i := range 5 {
+		mem.objects["uploads/image-"+strconv.Itoa(i)+".png"] = []byte("png")
+	}
+
+	var seen []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages == 5 {
+			t.Fatalf("still paging after 5 pages, seen %v", seen)
+		}
+		rec, _ := serve(t, srv, http.MethodGet, "/images?cursor="+cursor, nil, "")
+		var resp ListImagesResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if len(resp.Objects) == 0 || len(resp.Objects) == 5 {
+			t.Fatalf("page %d holds %d objects, want MAX_RESPONSE_BYTES to split the listing", pages, len(resp.Objects))
+		}
+		for _, obj := range resp.Objects {
+			seen = append(seen, obj.Key)
+		}
+		if !resp.Truncated {
+			break
+		}
+		if resp.NextCursor != seen[len(seen)-1] {
+			t.Fatalf("next cursor %q, want the last key returned %q", resp.NextCursor, seen[len(seen)-1])
+		}
+		cursor = resp.NextCursor
+	}
+	if want := mem.keys(); !slices.Equal(seen, want) {
+		t.Errorf("paged through %v, want %v", seen, want)
+	}
+}
+
+func TestEncodeJPEGTarget(t *testing.T) {
+	t.Cleanup(resetState)
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7919 % 251)
+	}
+	size := func(quality int) int64 {
+		var buf bytes.Buffer
+		jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+		return int64(buf.Len())
+	}
+	targetQualityMin, targetQualityMax, targetMaxEncodes = 30, 85, 10
+
+	targetFileSize = (size(50) + size(51)) / 2
+	buf, quality, err := encodeJPEGTarget(img)
+	if err != nil || quality != 50 || int64(buf.Len()) != size(50) {
+		t.Errorf("target between q50 and q51: quality %d, err %v, want 50", quality, err)
+	}
+
+	targetFileSize = size(85)
+	if _, quality, _ := encodeJPEGTarget(img); quality != 85 {
+		t.Errorf("target fitting TARGET_QUALITY_MAX: quality %d, want 85", quality)
+	}
+
+	targetFileSize = 1
+	if buf, quality, _ := encodeJPEGTarget(img); quality != 30 || int64(buf.Len()) != size(30) {
+		t.Errorf("unreachable target: quality %d, want the smallest encoding at 30", quality)
+	}
+
+	// Out of encodes, the best fit found so far is kept.
+	targetFileSize, targetMaxEncodes = size(80), 2
+	if buf, quality, _ := encodeJPEGTarget(img); int64(buf.Len()) > targetFileSize || quality < targetQualityMin {
+		t.Errorf("2 encodes: quality %d, size %d, want a fit under %d", quality, buf.Len(), targetFileSize)
+	}
+}
+
+func TestServerTargetFileSize(t *testing.T) {
+	srv, mem := newTestServer(t, Config{Settings: map[string]string{"TARGET_FILE_SIZE_KB": "64"}})
+
+	body, contentType := multipartPNGs(t, 1)
+	_, resp := serve(t, srv, http.MethodPost, "/upload?variants=thumb:2,big:3&convert=jpeg", body, contentType)
+	if len(resp.Files) != 1 {
+		t.Fatalf("files %+v, want 1", resp.Files)
+	}
+	tuned := resp.Files[0].VariantQuality
+	for _, name := range []string{"thumb", "big"} {
+		v := tuned[name]
+		key := strings.TrimPrefix(resp.Files[0].Variants[name], "https://cdn.example.com/")
+		if v.Quality != 85 || !v.TargetMet || v.Size != int64(len(mem.objects[key])) {
+			t.Errorf("%s: %+v for %d stored bytes, want quality 85 and the target met", name, v, len(mem.objects[key]))
+		}
+	}
+
+	body, contentType = multipartPNGs(t, 1)
+	if _, resp := serve(t, srv, http.MethodPost, "/upload?variants=thumb:2&convert=png", body, contentType); len(resp.Files) != 1 || resp.Files[0].VariantQuality != nil {
+		t.Errorf("PNG variant: files %+v, want no variant_quality", resp.Files)
+	}
+}
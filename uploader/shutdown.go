@@ -0,0 +1,43 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var shutdownTimeout = 30 * time.Second
+
+// waitForShutdown blocks until SIGINT or SIGTERM, then lets in-flight
+// requests finish, queued async uploads be stored and queued webhooks go out
+// for up to SHUTDOWN_TIMEOUT before logging the upload size summary. An
+// error from the listener in errs ends it early.
+func waitForShutdown(server *http.Server, s *Server, errs <-chan error) error {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	select {
+	case err := <-errs:
+		return err
+	case <-sig:
+	}
+
+	log.Println("Shutting down, waiting up to", shutdownTimeout, "for in-flight requests")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Graceful shutdown incomplete:", err)
+	} else if err := s.Shutdown(ctx); err != nil {
+		log.Println("Shutdown timeout reached before queued async uploads and webhooks finished")
+	}
+	uploadSizes.logSummary()
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
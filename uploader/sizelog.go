@@ -0,0 +1,30 @@
+package uploader
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+var logUploadSizes bool
+
+// logRequestSizes writes one structured line per upload request once the
+// body has been parsed, so requests that fail parsing never log sizes.
+// request_bytes is -1 for chunked requests, which declare no length.
+func logRequestSizes(r *http.Request, sizes []int64) {
+	if !logUploadSizes {
+		return
+	}
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	slog.Info("upload sizes",
+		"request_id", requestID(r),
+		"path", r.URL.Path,
+		"key_label", keyLabel(r),
+		"request_bytes", r.ContentLength,
+		"file_count", len(sizes),
+		"file_bytes", total,
+		"file_sizes", sizes,
+	)
+}
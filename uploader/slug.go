@@ -0,0 +1,58 @@
+package uploader
+
+import (
+	"strings"
+	"unicode"
+)
+
+const maxSlugLength = 50
+
+// slugPolicies map SLUG_POLICY names to the characters kept in a slug;
+// every other run of characters collapses into a single dash.
+var slugPolicies = map[string]func(r rune) bool{
+	"alphanumeric-dash": func(r rune) bool {
+		return r < unicode.MaxASCII && (unicode.IsLower(r) || unicode.IsDigit(r))
+	},
+	"alphanumeric-dash-underscore": func(r rune) bool {
+		return r < unicode.MaxASCII && (unicode.IsLower(r) || unicode.IsDigit(r) || r == '_')
+	},
+	"mixed-case": func(r rune) bool {
+		return r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_')
+	},
+}
+
+var slugEnabled bool
+var slugPolicy = "alphanumeric-dash"
+
+func initSlug() {
+	slugEnabled = envBool("FILENAME_SLUG")
+	if policy := getenv("SLUG_POLICY"); policy != "" {
+		if _, ok := slugPolicies[policy]; !ok {
+			fatal("Invalid SLUG_POLICY: must be alphanumeric-dash, alphanumeric-dash-underscore or mixed-case")
+		}
+		slugPolicy = policy
+	}
+}
+
+func slugify(name string) string {
+	keep := slugPolicies[slugPolicy]
+	if slugPolicy != "mixed-case" {
+		name = strings.ToLower(name)
+	}
+
+	var b strings.Builder
+	dash := false
+	for _, r := range name {
+		if keep(r) {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+		if b.Len() >= maxSlugLength {
+			break
+		}
+	}
+	return strings.Trim(b.String(), "-")
+}
@@ -0,0 +1,84 @@
+package uploader
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+var sniffedExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+	"image/gif":  ".gif",
+	"image/avif": ".avif",
+}
+
+// sniffImage reads the first 512 bytes of r and returns them along with the
+// detected MIME type, so callers can stitch the header back onto the stream.
+func sniffImage(r io.Reader) ([]byte, string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, "", err
+	}
+	head = head[:n]
+	if isAVIF(head) {
+		return head, "image/avif", nil
+	}
+	return head, http.DetectContentType(head), nil
+}
+
+// isAVIF checks for an ISO-BMFF ftyp box branded avif (still) or avis
+// (sequence), which http.DetectContentType doesn't know.
+func isAVIF(head []byte) bool {
+	if len(head) < 12 || string(head[4:8]) != "ftyp" {
+		return false
+	}
+	brand := string(head[8:12])
+	return brand == "avif" || brand == "avis"
+}
+
+// sniffExtension picks an extension for an upload whose filename has none,
+// based on its magic bytes.
+func sniffExtension(header *formFile) (string, bool) {
+	file, err := header.Open()
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+	_, sniffed, err := sniffImage(file)
+	if err != nil {
+		return "", false
+	}
+	ext, ok := sniffedExtensions[sniffed]
+	return ext, ok
+}
+
+var errNotImage = errors.New("not an allowed image type")
+
+// typeMismatchError is returned when the content is a supported image, just
+// not the one the filename's extension claims.
+type typeMismatchError struct {
+	declared, detected string
+}
+
+func (e *typeMismatchError) Error() string {
+	return "content is " + e.detected + ", but the extension says " + e.declared
+}
+
+// verifyContentType sniffs r and returns its MIME type if it is an allowed
+// image agreeing with name's extension.
+func verifyContentType(r io.Reader, name string) (string, error) {
+	_, sniffed, err := sniffImage(r)
+	if err != nil {
+		return "", err
+	}
+	if !allowedTypes[sniffed] {
+		return "", errNotImage
+	}
+	if declared := detectContentType(name); declared != sniffed {
+		return "", &typeMismatchError{declared: declared, detected: sniffed}
+	}
+	return sniffed, nil
+}
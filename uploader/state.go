@@ -0,0 +1,161 @@
+package uploader
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Settings are package state, so one Server runs per process. New refuses
+// to build a second one until the first has shut down, and starts every
+// Server from the package defaults rather than from what the last one set.
+var active struct {
+	sync.Mutex
+	server *Server
+}
+
+var errServerActive = errors.New("uploader: a Server is already running in this process; Shutdown it before calling New again")
+
+// defaults restores each setting an init function may change to the value
+// it had before the first New. A new setting must be added to init below.
+var defaults []func()
+
+func keep[T any](p *T) {
+	def := *p
+	defaults = append(defaults, func() { *p = def })
+}
+
+func init() {
+	keep(&aliasesEnabled)
+	keep(&aliasCacheControl)
+	keep(&asyncWorkers)
+	keep(&asyncQueueSize)
+	keep(&jobTTL)
+	keep(&uploadBreaker)
+	keep(&processingBudget)
+	keep(&camelCaseFields)
+	keep(&contentMD5)
+	keep(&logTypeCorrections)
+	keep(&allowedOrigins)
+	keep(&decodeSlots)
+	keep(&decodeQueueTimeout)
+	keep(&dedupeDefault)
+	keep(&uniquenessScope)
+	keep(&maxDeleteKeys)
+	keep(&deleteConcurrency)
+	keep(&maxDimensions)
+	keep(&entropyCheck)
+	keep(&entropyMaxChiSquare)
+	keep(&entropyMinSize)
+	keep(&extractMetadata)
+	keep(&fallback)
+	keep(&uploadFields)
+	keep(&uploadFieldPolicy)
+	keep(&maxRequestsPerIP)
+	keep(&trustedProxies)
+	keep(&keyStrategy)
+	keep(&localFiles)
+	keep(&metadataSchema)
+	keep(&metricsEnabled)
+	keep(&metricsToken)
+	keep(&formMemory)
+	keep(&multipartPartSize)
+	keep(&multipartConcurrency)
+	keep(&polyglotCheck)
+	keep(&presignedUploads)
+	keep(&presignUploadExpiry)
+	keep(&progressTTL)
+	keep(&keyRateLimits)
+	keep(&ipRateLimits)
+	keep(&defaultBaseName)
+	keep(&receiptAlgorithm)
+	keep(&receiptHMACKey)
+	keep(&receiptPrivateKey)
+	keep(&r2MaxAttempts)
+	keep(&maxRetryAfter)
+	keep(&retryJitter)
+	keep(&readHeaderTimeout)
+	keep(&readTimeout)
+	keep(&writeTimeout)
+	keep(&idleTimeout)
+	keep(&shutdownTimeout)
+	keep(&logUploadSizes)
+	keep(&slugEnabled)
+	keep(&slugPolicy)
+	keep(&largestObjectsMax)
+	keep(&largestObjectsTTL)
+	keep(&maxResponseBytes)
+	keep(&storage)
+	keep(&stripExif)
+	keep(&namespaceByKey)
+	keep(&tenantConfigs)
+	keep(&uploadLimiter)
+	keep(&tlsCertFiles)
+	keep(&tlsKeyFiles)
+	keep(&softDelete)
+	keep(&trashRetention)
+	keep(&trashSweepInterval)
+	keep(&maxFiles)
+	keep(&allowedExtensions)
+	keep(&allowedTypes)
+	keep(&allFailedClientStatus)
+	keep(&allFailedServerStatus)
+	keep(&uploadTimeout)
+	keep(&batchTimeout)
+	keep(&deleteTimeout)
+	keep(&uploadConcurrency)
+	keep(&cleanupCanceledUploads)
+	keep(&privateBucket)
+	keep(&presignExpiry)
+	keep(&publicURL)
+	keep(&apiKey)
+	keep(&adminKey)
+	keep(&allowKeyInQuery)
+	keep(&keyShardLength)
+	keep(&maxFileSize)
+	keep(&minFileSize)
+	keep(&maxVariants)
+	keep(&maxDerivatives)
+	keep(&maxDecodePixels)
+	keep(&sharpenAmount)
+	keep(&targetFileSize)
+	keep(&targetQualityMin)
+	keep(&targetQualityMax)
+	keep(&targetMaxEncodes)
+	keep(&thumbnailExt)
+	keep(&autoRotateHeuristic)
+	keep(&warmupTimeout)
+	keep(&zipMaxKeys)
+	keep(&zipMissingPolicy)
+}
+
+// resetState puts the package back the way it was before the first New:
+// settings at their defaults and the keys, tenants, quota usage, progress,
+// caches and metrics an earlier Server collected gone. Only the upload size
+// histogram, which is summarized when the process exits, is kept.
+func resetState() {
+	for _, restore := range defaults {
+		restore()
+	}
+	settings = nil
+
+	apiKeys = map[string]string{}
+	tenants = map[string]*tenant{}
+	typeDimensions = map[string]dimensionLimit{}
+	quotas.limits, quotas.used = map[string]int64{}, map[string]int64{}
+	dailyQuotas.limits, dailyQuotas.used, dailyQuotas.day = map[string]int64{}, map[string]int64{}, ""
+	inFlightByIP.counts = map[string]int{}
+	progressStore.entries = map[string]*uploadProgress{}
+	typeCorrections.counts = map[correctionKey]int64{}
+	largestCache.objects, largestCache.scannedAt, largestCache.scan = nil, time.Time{}, nil
+	disabledTypes.Store(nil)
+	fromEnvFile, shadowed = map[string]string{}, map[string]string{}
+	tlsCertificates.Store(nil)
+
+	uploadsTotal = counterVec{}
+	uploadFailures = counterVec{}
+	uploadDuration = histogramVec{}
+	storageBytes = counterVec{}
+	httpRequests = counterVec{}
+	httpRequestSeconds = histogramVec{}
+}
@@ -0,0 +1,230 @@
+package uploader
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type ObjectInfo struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+	URL  string `json:"url"`
+}
+
+type LargestObjectsResponse struct {
+	Status    int          `json:"status"`
+	Message   string       `json:"message"`
+	Objects   []ObjectInfo `json:"objects"`
+	ScannedAt time.Time    `json:"scanned_at"`
+	Cached    bool         `json:"cached"`
+	// Truncated is set when the page hit MAX_RESPONSE_BYTES; NextCursor
+	// fetches the rest.
+	Truncated  bool   `json:"truncated"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+var largestObjectsMax = 100
+var largestObjectsTTL = 5 * time.Minute
+var maxResponseBytes = 1 << 20
+
+// largestCache holds the last /stats/largest scan. The lock only guards the
+// fields; the scan itself runs outside it, and requests that miss the cache
+// while a scan is running wait for that scan instead of starting another.
+var largestCache struct {
+	sync.Mutex
+	objects   []ObjectInfo
+	scannedAt time.Time
+	scan      *largestScan // running, or nil
+}
+
+type largestScan struct {
+	done      chan struct{}
+	objects   []ObjectInfo
+	scannedAt time.Time
+	err       error
+}
+
+// largestObjects returns the cached scan while it is fresh, and otherwise
+// the result of a new one, shared with every request that asks meanwhile.
+// The request that starts the scan sees it through even if its client goes
+// away, since others may be waiting on it.
+func largestObjects(ctx context.Context) (objects []ObjectInfo, scannedAt time.Time, cached bool, err error) {
+	largestCache.Lock()
+	if largestCache.objects != nil && time.Since(largestCache.scannedAt) < largestObjectsTTL {
+		defer largestCache.Unlock()
+		return largestCache.objects, largestCache.scannedAt, true, nil
+	}
+	scan := largestCache.scan
+	if scan != nil {
+		largestCache.Unlock()
+		select {
+		case <-scan.done:
+			return scan.objects, scan.scannedAt, false, scan.err
+		case <-ctx.Done():
+			return nil, time.Time{}, false, ctx.Err()
+		}
+	}
+	scan = &largestScan{done: make(chan struct{})}
+	largestCache.scan = scan
+	largestCache.Unlock()
+
+	scan.objects, scan.err = findLargestObjects(context.WithoutCancel(ctx), largestObjectsMax)
+	scan.scannedAt = time.Now()
+	if scan.err != nil {
+		log.Println("Largest objects scan failed:", scan.err)
+	}
+	largestCache.Lock()
+	if scan.err == nil {
+		largestCache.objects, largestCache.scannedAt = scan.objects, scan.scannedAt
+	}
+	largestCache.scan = nil
+	largestCache.Unlock()
+	close(scan.done)
+	return scan.objects, scan.scannedAt, false, scan.err
+}
+
+func initStats() {
+	largestObjectsMax = envInt("LARGEST_OBJECTS_MAX", largestObjectsMax)
+	largestObjectsTTL = envDuration("LARGEST_OBJECTS_CACHE_TTL", largestObjectsTTL)
+	maxResponseBytes = envInt("MAX_RESPONSE_BYTES", maxResponseBytes)
+}
+
+// scanObjects walks every object under prefix in the primary store.
+func scanObjects(ctx context.Context, prefix string, fn func(StoredObject)) error {
+	return storage.Scan(ctx, prefix, fn)
+}
+
+type objectHeap []ObjectInfo
+
+func (h objectHeap) Len() int           { return len(h) }
+func (h objectHeap) Less(i, j int) bool { return h[i].Size < h[j].Size }
+func (h objectHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *objectHeap) Push(x any)        { *h = append(*h, x.(ObjectInfo)) }
+func (h *objectHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// findLargestObjects keeps only the n largest objects seen so far in a
+// min-heap, so memory stays bounded no matter how many keys the scan visits.
+func findLargestObjects(ctx context.Context, n int) ([]ObjectInfo, error) {
+	h := &objectHeap{}
+	err := scanObjects(ctx, scanPrefix(), func(obj StoredObject) {
+		if !isUploadKey(obj.Key) {
+			return
+		}
+		if h.Len() < n {
+			heap.Push(h, ObjectInfo{Key: obj.Key, Size: obj.Size})
+			return
+		}
+		if obj.Size > (*h)[0].Size {
+			(*h)[0] = ObjectInfo{Key: obj.Key, Size: obj.Size}
+			heap.Fix(h, 0)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]ObjectInfo, h.Len())
+	for i := len(objects) - 1; i >= 0; i-- {
+		obj := heap.Pop(h).(ObjectInfo)
+		if obj.URL, err = objectURL(ctx, obj.Key); err != nil {
+			return nil, err
+		}
+		objects[i] = obj
+	}
+	return objects, nil
+}
+
+func largestObjectsHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	n := 10
+	if v := r.URL.Query().Get("n"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 {
+			sendJSON(w, 400, map[string]interface{}{"status": 400, "message": "n must be a positive integer"})
+			return
+		}
+		n = parsed
+	}
+	if n > largestObjectsMax {
+		n = largestObjectsMax
+	}
+	offset := 0
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 0 {
+			sendJSON(w, 400, map[string]interface{}{"status": 400, "message": "Invalid cursor"})
+			return
+		}
+		offset = parsed
+	}
+
+	objects, scannedAt, cached, err := largestObjects(r.Context())
+	if err != nil {
+		sendJSON(w, 502, map[string]interface{}{"status": 502, "message": "Failed to scan bucket"})
+		return
+	}
+
+	if len(objects) > n {
+		objects = objects[:n]
+	}
+	objects = objects[min(offset, len(objects)):]
+	page := fitResponse(objects)
+	resp := LargestObjectsResponse{
+		Status:    200,
+		Message:   strconv.Itoa(len(page)) + " largest object(s)",
+		Objects:   page,
+		ScannedAt: scannedAt,
+		Cached:    cached,
+	}
+	if len(page) < len(objects) {
+		resp.Truncated = true
+		resp.NextCursor = strconv.Itoa(offset + len(page))
+	}
+	sendJSON(w, 200, resp)
+}
+
+// fitResponse returns the leading objects whose JSON stays within
+// MAX_RESPONSE_BYTES, always at least one so paging makes progress.
+func fitResponse(objects []ObjectInfo) []ObjectInfo {
+	size := 0
+	for i, obj := range objects {
+		encoded, _ := json.Marshal(obj)
+		if size += len(encoded) + 1; size > maxResponseBytes && i > 0 {
+			return objects[:i]
+		}
+	}
+	return objects
+}
+
+type RuntimeStatsResponse struct {
+	Status          int              `json:"status"`
+	Message         string           `json:"message"`
+	CircuitBreaker  *BreakerStatus   `json:"circuit_breaker,omitempty"`
+	TypeCorrections []TypeCorrection `json:"type_corrections"`
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	sendJSON(w, 200, RuntimeStatsResponse{
+		Status:          200,
+		Message:         "ok",
+		CircuitBreaker:  uploadBreaker.status(),
+		TypeCorrections: typeCorrectionStats(),
+	})
+}
@@ -0,0 +1,329 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Storage is an object store the handlers read and write through. Keys are
+// full object keys, and looking up one that doesn't exist fails with an
+// error wrapping fs.ErrNotExist or the S3 not-found errors.
+type Storage interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, opts UploadOptions) error
+	Get(ctx context.Context, key string) (io.ReadCloser, StoredObject, error)
+	Head(ctx context.Context, key string) (StoredObject, error)
+	// Copy keeps from's headers and metadata, or replaces them with headers
+	// when it isn't nil.
+	Copy(ctx context.Context, from, to string, headers *ObjectHeaders) error
+	// Delete succeeds for a key that doesn't exist, as in S3.
+	Delete(ctx context.Context, key string) error
+	// DeleteBatch removes up to deleteBatchSize keys at once; errs[i] is the
+	// failure for keys[i].
+	DeleteBatch(ctx context.Context, keys []string) (errs []error)
+	// List returns up to limit objects under prefix in key order, after
+	// cursor, the last key of an earlier page, or "" for the first.
+	List(ctx context.Context, prefix, cursor string, limit int) (ListPage, error)
+	Scan(ctx context.Context, prefix string, fn func(StoredObject)) error
+	PresignPut(ctx context.Context, key, contentType string, size int64, expiry time.Duration) (PresignedPut, error)
+	// PublicURL is where clients fetch key: a public URL, or a presigned GET
+	// for private buckets.
+	PublicURL(ctx context.Context, key string) (string, error)
+	// Ping checks that the store is reachable.
+	Ping(ctx context.Context) error
+}
+
+type StoredObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+type ListPage struct {
+	Objects []StoredObject
+	// NextCursor is "" on the last page.
+	NextCursor string
+}
+
+// PresignedPut is a signed request a client sends itself, with the headers
+// exactly as given.
+type PresignedPut struct {
+	URL     string
+	Method  string
+	Headers http.Header
+}
+
+type ObjectHeaders struct {
+	ContentType  string
+	CacheControl string
+	Metadata     map[string]string
+}
+
+var errPresignUnsupported = errors.New("presigned uploads are not supported by this storage backend")
+
+// storage is the primary store: R2 unless STORAGE_BACKEND says otherwise.
+var storage Storage
+
+func initStorage() {
+	switch backend := getenv("STORAGE_BACKEND"); backend {
+	case "", "r2":
+		initS3Storage(false)
+	case "s3":
+		initS3Storage(true)
+	case "local":
+		initLocalStorage()
+	default:
+		fatal("Invalid STORAGE_BACKEND: must be r2, s3 or local")
+	}
+}
+
+// initS3Storage sets up R2 or, when generic, any S3-compatible endpoint such
+// as MinIO under S3_ENDPOINT. Both take the bucket and credentials from the
+// R2_* variables.
+func initS3Storage(generic bool) {
+	bucketName := getenv("R2_BUCKET_NAME")
+	publicURL = getenv("R2_PUBLIC_URL")
+	accessKey := getenv("R2_ACCESS_KEY")
+	secretKey := getenv("R2_SECRET_KEY")
+	accountID := getenv("R2_ACCOUNT_ID")
+
+	switch visibility := getenv("BUCKET_VISIBILITY"); visibility {
+	case "", "public":
+	case "private":
+		privateBucket = true
+	default:
+		fatal("Invalid BUCKET_VISIBILITY: must be public or private")
+	}
+
+	region, endpoint := "auto", "https://"+accountID+".r2.cloudflarestorage.com"
+	if generic {
+		endpoint = getenv("S3_ENDPOINT")
+		if u, err := url.Parse(endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			fatal("Invalid S3_ENDPOINT: must be an endpoint URL such as http://localhost:9000")
+		}
+		if region = getenv("S3_REGION"); region == "" {
+			region = "us-east-1"
+		}
+		if bucketName == "" || accessKey == "" || secretKey == "" {
+			fatal("Missing required environment variables: R2_BUCKET_NAME, R2_ACCESS_KEY, R2_SECRET_KEY")
+		}
+	} else if bucketName == "" || accessKey == "" || secretKey == "" || accountID == "" {
+		fatal("Missing required environment variables: R2_BUCKET_NAME, R2_ACCESS_KEY, R2_SECRET_KEY, R2_ACCOUNT_ID")
+	}
+	if publicURL == "" && !privateBucket {
+		fatal("Missing required environment variable: R2_PUBLIC_URL (or set BUCKET_VISIBILITY=private)")
+	}
+
+	presignExpiry = envDuration("PRESIGN_EXPIRY", presignExpiry)
+	if privateBucket && (presignExpiry < time.Second || presignExpiry > 7*24*time.Hour) {
+		fatal("Invalid PRESIGN_EXPIRY: must be between 1s and 168h for private buckets")
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background(),
+		config.WithRegion(region),
+		config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(accessKey, secretKey, ""),
+		),
+		config.WithRetryer(newRetryer),
+	)
+
+	if err != nil {
+		fatal("Failed to load R2 config:", err)
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.BaseEndpoint = aws.String(endpoint)
+		o.UsePathStyle = generic && envBool("S3_PATH_STYLE")
+	})
+	base := publicURL
+	if privateBucket {
+		base = ""
+	}
+	storage = newS3Storage(client, bucketName, base)
+}
+
+// s3Storage is a bucket on R2 or another S3-compatible service.
+type s3Storage struct {
+	client  *s3.Client
+	presign *s3.PresignClient
+	bucket  string
+	// publicURL is the base of public URLs, or "" to hand out presigned GETs.
+	publicURL string
+}
+
+func newS3Storage(client *s3.Client, bucket, publicURL string) *s3Storage {
+	return &s3Storage{
+		client:    client,
+		presign:   s3.NewPresignClient(client),
+		bucket:    bucket,
+		publicURL: publicURL,
+	}
+}
+
+func (s *s3Storage) Put(ctx context.Context, key string, body io.Reader, size int64, opts UploadOptions) error {
+	return putObject(ctx, s.client, putObjectInput(s.bucket, body, size, key, opts))
+}
+
+func (s *s3Storage) Get(ctx context.Context, key string) (io.ReadCloser, StoredObject, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, StoredObject{}, err
+	}
+	return out.Body, StoredObject{Key: key, Size: aws.ToInt64(out.ContentLength), LastModified: aws.ToTime(out.LastModified)}, nil
+}
+
+func (s *s3Storage) Head(ctx context.Context, key string) (StoredObject, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	if err != nil {
+		return StoredObject{}, err
+	}
+	return StoredObject{Key: key, Size: aws.ToInt64(out.ContentLength), LastModified: aws.ToTime(out.LastModified)}, nil
+}
+
+func (s *s3Storage) Copy(ctx context.Context, from, to string, headers *ObjectHeaders) error {
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        aws.String(to),
+		CopySource: aws.String(copySource(s.bucket, from)),
+	}
+	if headers != nil {
+		input.MetadataDirective = types.MetadataDirectiveReplace
+		input.ContentType = aws.String(headers.ContentType)
+		input.CacheControl = aws.String(headers.CacheControl)
+		input.Metadata = headers.Metadata
+	}
+	_, err := s.client.CopyObject(ctx, input)
+	return err
+}
+
+// copySource is the x-amz-copy-source value for key. The header is a URL
+// path, so each segment is escaped: keys may hold spaces, '+', '?' or '%',
+// which would otherwise name a different object or fail to parse.
+func copySource(bucket, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return bucket + "/" + strings.Join(segments, "/")
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	return err
+}
+
+func (s *s3Storage) DeleteBatch(ctx context.Context, keys []string) []error {
+	errs := make([]error, len(keys))
+	objects := make([]types.ObjectIdentifier, len(keys))
+	index := make(map[string][]int, len(keys))
+	for i, key := range keys {
+		objects[i] = types.ObjectIdentifier{Key: aws.String(key)}
+		index[key] = append(index[key], i)
+	}
+	out, err := s.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(s.bucket),
+		Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+	})
+	if err != nil {
+		logStorageError("DeleteObjects", fmt.Sprintf("%d keys", len(keys)), err)
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	for _, e := range out.Errors {
+		for _, i := range index[aws.ToString(e.Key)] {
+			errs[i] = fmt.Errorf("%s: %s", aws.ToString(e.Code), aws.ToString(e.Message))
+		}
+	}
+	return errs
+}
+
+func (s *s3Storage) List(ctx context.Context, prefix, cursor string, limit int) (ListPage, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int32(int32(limit)),
+	}
+	// Cursors are keys rather than continuation tokens, so a caller can
+	// resume after any object of a page, not only the last.
+	if cursor != "" {
+		input.StartAfter = aws.String(cursor)
+	}
+	out, err := s.client.ListObjectsV2(ctx, input)
+	if err != nil {
+		return ListPage{}, err
+	}
+	page := ListPage{Objects: make([]StoredObject, 0, len(out.Contents))}
+	for _, obj := range out.Contents {
+		page.Objects = append(page.Objects, storedObject(obj))
+	}
+	if aws.ToBool(out.IsTruncated) && len(page.Objects) > 0 {
+		page.NextCursor = page.Objects[len(page.Objects)-1].Key
+	}
+	return page, nil
+}
+
+func (s *s3Storage) Scan(ctx context.Context, prefix string, fn func(StoredObject)) error {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			fn(storedObject(obj))
+		}
+	}
+	return nil
+}
+
+func storedObject(obj types.Object) StoredObject {
+	return StoredObject{Key: aws.ToString(obj.Key), Size: aws.ToInt64(obj.Size), LastModified: aws.ToTime(obj.LastModified)}
+}
+
+func (s *s3Storage) PresignPut(ctx context.Context, key, contentType string, size int64, expiry time.Duration) (PresignedPut, error) {
+	req, err := s.presign.PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(size),
+	}, s3.WithPresignExpires(expiry))
+	if err != nil {
+		return PresignedPut{}, err
+	}
+	return PresignedPut{URL: req.URL, Method: req.Method, Headers: req.SignedHeader}, nil
+}
+
+func (s *s3Storage) PublicURL(ctx context.Context, key string) (string, error) {
+	if s.publicURL != "" {
+		return s.publicURL + "/" + key, nil
+	}
+	req, err := s.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(presignExpiry))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+func (s *s3Storage) Ping(ctx context.Context) error {
+	_, err := s.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	return err
+}
@@ -0,0 +1,322 @@
+package uploader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+var stripExif bool
+
+var errStripFailed = errors.New("could not strip image metadata")
+
+// stripMetadata removes EXIF, XMP, IPTC and text comments from JPEG, PNG and
+// WebP files without re-encoding them, so pixels, ICC profiles and encoder
+// settings are unchanged. EXIF orientation is the one tag kept, written into
+// a minimal EXIF block of its own, since dropping it would show photos taken
+// in portrait sideways. Other types carry no EXIF and are returned as is.
+//
+// Only the segment and chunk headers are read. The result splices the parts
+// of src that are kept with the few bytes that change, so the image data is
+// read from src as the result is, never copied.
+func stripMetadata(src io.ReaderAt, size int64, contentType string) (*splicedReader, error) {
+	out := &splicedReader{}
+	var err error
+	switch contentType {
+	case "image/jpeg":
+		err = stripJPEG(out, src, size)
+	case "image/png":
+		err = stripPNG(out, src, size)
+	case "image/webp":
+		err = stripWebP(out, src, size)
+	default:
+		out.copy(src, 0, size)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// orientationExif is a TIFF block holding only the orientation tag, or nil
+// when tiff sets the default orientation or none at all.
+func orientationExif(tiff []byte) []byte {
+	var meta ImageMetadata
+	parseExif(tiff, &meta)
+	if meta.Orientation == 0 {
+		return nil
+	}
+	out := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01")
+	out = binary.BigEndian.AppendUint16(out, tagOrientation)
+	out = binary.BigEndian.AppendUint16(out, 3) // SHORT
+	out = binary.BigEndian.AppendUint32(out, 1)
+	out = binary.BigEndian.AppendUint16(out, uint16(meta.Orientation))
+	return append(out, 0, 0, 0, 0, 0, 0) // value padding, no next IFD
+}
+
+// readAt reads n bytes at off, or fails when the file ends first.
+func readAt(src io.ReaderAt, off int64, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := src.ReadAt(buf, off); err != nil {
+		return nil, errStripFailed
+	}
+	return buf, nil
+}
+
+// stripJPEG drops APP1 (EXIF and XMP), APP13 (IPTC) and COM segments ahead
+// of the image data. Everything from the start of scan on is copied as is.
+func stripJPEG(out *splicedReader, src io.ReaderAt, size int64) error {
+	if soi, err := readAt(src, 0, 2); err != nil || soi[0] != 0xff || soi[1] != 0xd8 {
+		return errStripFailed
+	}
+	out.copy(src, 0, 2)
+	orientationDone := false
+	pos := int64(2)
+	for {
+		header, err := readAt(src, pos, 4)
+		if err != nil || header[0] != 0xff {
+			return errStripFailed
+		}
+		marker := header[1]
+		if marker == 0xff { // fill byte
+			pos++
+			continue
+		}
+		if marker == 0xda { // start of scan
+			break
+		}
+		end := pos + 2 + int64(binary.BigEndian.Uint16(header[2:]))
+		if end > size || end < pos+4 {
+			return errStripFailed
+		}
+		switch marker {
+		case 0xe1:
+			if orientationDone {
+				break
+			}
+			segment, err := readAt(src, pos+4, int(end-pos-4))
+			if err != nil {
+				return err
+			}
+			if tiff, ok := bytes.CutPrefix(segment, []byte("Exif\x00\x00")); ok {
+				orientationDone = true
+				if orientation := orientationExif(tiff); orientation != nil {
+					app1 := binary.BigEndian.AppendUint16([]byte{0xff, 0xe1}, uint16(2+6+len(orientation)))
+					out.insert(append(append(app1, "Exif\x00\x00"...), orientation...))
+				}
+			}
+		case 0xed, 0xfe:
+		default:
+			out.copy(src, pos, end-pos)
+		}
+		pos = end
+	}
+	out.copy(src, pos, size-pos)
+	return nil
+}
+
+// stripPNG drops the eXIf chunk and the tEXt, zTXt and iTXt chunks, which is
+// where XMP and other text metadata live.
+func stripPNG(out *splicedReader, src io.ReaderAt, size int64) error {
+	if size < 8 {
+		return errStripFailed
+	}
+	out.copy(src, 0, 8)
+	var orientation []byte
+	pos := int64(8)
+	for pos < size {
+		header, err := readAt(src, pos, 8)
+		if err != nil {
+			return err
+		}
+		end := pos + 12 + int64(binary.BigEndian.Uint32(header))
+		if end > size {
+			return errStripFailed
+		}
+		switch string(header[4:]) {
+		case "eXIf":
+			if end-pos-12 > maxExifSize {
+				break
+			}
+			tiff, err := readAt(src, pos+8, int(end-pos-12))
+			if err != nil {
+				return err
+			}
+			orientation = orientationExif(tiff)
+		case "tEXt", "zTXt", "iTXt":
+		case "IDAT":
+			// eXIf has to come before the image data.
+			if orientation != nil {
+				out.insert(pngChunk("eXIf", orientation))
+				orientation = nil
+			}
+			fallthrough
+		default:
+			out.copy(src, pos, end-pos)
+		}
+		pos = end
+	}
+	return nil
+}
+
+func pngChunk(kind string, body []byte) []byte {
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	out = append(append(out, kind...), body...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[4:]))
+}
+
+// stripWebP drops the EXIF and XMP chunks of an extended WebP file and
+// clears their flags in the VP8X header. Simple WebP files can't carry
+// metadata at all.
+func stripWebP(out *splicedReader, src io.ReaderAt, size int64) error {
+	riff, err := readAt(src, 0, 12)
+	if err != nil || string(riff[:4]) != "RIFF" || string(riff[8:12]) != "WEBP" {
+		return errStripFailed
+	}
+	const flagXMP, flagEXIF = 0x04, 0x08
+	// The RIFF size is filled in once the kept chunks are known.
+	out.insert(riff)
+	var vp8x []byte
+	var orientation []byte
+	pos := int64(12)
+	for pos < size {
+		header, err := readAt(src, pos, 8)
+		if err != nil {
+			return err
+		}
+		n := int64(binary.LittleEndian.Uint32(header[4:]))
+		end := pos + 8 + n + n&1
+		if end > size {
+			return errStripFailed
+		}
+		switch string(header[:4]) {
+		case "EXIF":
+			if n > maxExifSize {
+				break
+			}
+			data, err := readAt(src, pos+8, int(n))
+			if err != nil {
+				return err
+			}
+			tiff, _ := bytes.CutPrefix(data, []byte("Exif\x00\x00"))
+			orientation = orientationExif(tiff)
+		case "XMP ":
+		case "VP8X":
+			if vp8x, err = readAt(src, pos, int(end-pos)); err != nil {
+				return err
+			}
+			out.insert(vp8x)
+		default:
+			out.copy(src, pos, end-pos)
+		}
+		pos = end
+	}
+	if len(vp8x) > 8 {
+		vp8x[8] &^= flagXMP | flagEXIF
+		// The spec puts EXIF after the image data, so it goes last.
+		if orientation != nil {
+			vp8x[8] |= flagEXIF
+			chunk := binary.LittleEndian.AppendUint32([]byte("EXIF"), uint32(len(orientation)))
+			out.insert(append(chunk, orientation...))
+		}
+	}
+	binary.LittleEndian.PutUint32(riff[4:], uint32(out.Size()-8))
+	return nil
+}
+
+// splicedReader reads a file made of ranges of another file and of bytes
+// held here. It seeks, so the stripped file can be hashed, inspected and
+// uploaded like the original.
+type splicedReader struct {
+	parts []splicePart
+	size  int64
+	off   int64
+}
+
+type splicePart struct {
+	src  io.ReaderAt // nil for data
+	data []byte
+	at   int64
+	n    int64
+}
+
+// copy appends n bytes of src from at, joining them onto the previous range
+// when they follow it.
+func (s *splicedReader) copy(src io.ReaderAt, at, n int64) {
+	if n <= 0 {
+		return
+	}
+	if last := len(s.parts) - 1; last >= 0 && s.parts[last].src == src && s.parts[last].at+s.parts[last].n == at {
+		s.parts[last].n += n
+	} else {
+		s.parts = append(s.parts, splicePart{src: src, at: at, n: n})
+	}
+	s.size += n
+}
+
+// insert appends data. It is read when the result is, so the caller may still
+// change it until then.
+func (s *splicedReader) insert(data []byte) {
+	s.parts = append(s.parts, splicePart{data: data, n: int64(len(data))})
+	s.size += int64(len(data))
+}
+
+func (s *splicedReader) Size() int64 { return s.size }
+
+func (s *splicedReader) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	start := int64(0)
+	for _, part := range s.parts {
+		if read == len(p) {
+			break
+		}
+		if off >= start+part.n {
+			start += part.n
+			continue
+		}
+		from := off - start
+		chunk := p[read:min(int64(len(p)), int64(read)+part.n-from)]
+		var n int
+		var err error
+		if part.src == nil {
+			n = copy(chunk, part.data[from:])
+		} else if n, err = part.src.ReadAt(chunk, part.at+from); err == io.EOF && n == len(chunk) {
+			err = nil
+		}
+		read += n
+		off += int64(n)
+		if err != nil {
+			return read, err
+		}
+		start += part.n
+	}
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (s *splicedReader) Read(p []byte) (int, error) {
+	if s.off >= s.size {
+		return 0, io.EOF
+	}
+	n, err := s.ReadAt(p[:min(int64(len(p)), s.size-s.off)], s.off)
+	s.off += int64(n)
+	return n, err
+}
+
+func (s *splicedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.off
+	case io.SeekEnd:
+		offset += s.size
+	}
+	if offset < 0 {
+		return 0, errors.New("strip: negative position")
+	}
+	s.off = offset
+	return offset, nil
+}
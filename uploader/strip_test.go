@@ -0,0 +1,176 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// exifTIFF is a TIFF block with a camera make and the given orientation.
+func exifTIFF(orientation uint16) []byte {
+	be := binary.BigEndian
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = be.AppendUint16(tiff, 2)
+	tiff = be.AppendUint16(tiff, tagMake)
+	tiff = be.AppendUint16(tiff, 2) // ASCII
+	tiff = be.AppendUint32(tiff, 4)
+	tiff = append(tiff, "Nik\x00"...)
+	tiff = be.AppendUint16(tiff, tagOrientation)
+	tiff = be.AppendUint16(tiff, 3) // SHORT
+	tiff = be.AppendUint32(tiff, 1)
+	tiff = be.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0)
+	return be.AppendUint32(tiff, 0)
+}
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for y := range 8 {
+		for x := range 16 {
+			img.Set(x, y, color.RGBA{R: uint8(x * 16), G: uint8(y * 32), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+// stripped runs stripMetadata over data and checks the result is clean of
+// the test metadata and keeps the given orientation.
+func stripped(t *testing.T, data []byte, contentType string, orientation int) []byte {
+	t.Helper()
+	r, err := stripMetadata(bytes.NewReader(data), int64(len(data)), contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(out)) != r.Size() {
+		t.Errorf("read %d bytes, Size says %d", len(out), r.Size())
+	}
+	for _, secret := range []string{"Nik", "secret"} {
+		if bytes.Contains(out, []byte(secret)) {
+			t.Errorf("stripped file still contains %q", secret)
+		}
+	}
+	meta := readImageMetadata(context.Background(), bytes.NewReader(out))
+	if meta == nil || meta.Orientation != orientation || meta.CameraMake != "" {
+		t.Errorf("metadata after stripping = %+v, want only orientation %d", meta, orientation)
+	}
+	return out
+}
+
+func samePixels(t *testing.T, a, b image.Image) {
+	t.Helper()
+	if a.Bounds() != b.Bounds() {
+		t.Fatalf("bounds %v, want %v", b.Bounds(), a.Bounds())
+	}
+	for y := a.Bounds().Min.Y; y < a.Bounds().Max.Y; y++ {
+		for x := a.Bounds().Min.X; x < a.Bounds().Max.X; x++ {
+			if a.At(x, y) != b.At(x, y) {
+				t.Fatalf("pixel (%d,%d) is %v, want %v", x, y, b.At(x, y), a.At(x, y))
+			}
+		}
+	}
+}
+
+func TestStripJPEG(t *testing.T) {
+	var enc bytes.Buffer
+	if err := jpeg.Encode(&enc, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	segment := func(marker byte, body string) []byte {
+		return append(binary.BigEndian.AppendUint16([]byte{0xff, marker}, uint16(2+len(body))), body...)
+	}
+	var data []byte
+	data = append(data, enc.Bytes()[:2]...)
+	data = append(data, segment(0xe1, "Exif\x00\x00"+string(exifTIFF(6)))...)
+	data = append(data, segment(0xe1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>secret</x:xmpmeta>")...)
+	data = append(data, segment(0xfe, "secret comment")...)
+	data = append(data, enc.Bytes()[2:]...)
+
+	out := stripped(t, data, "image/jpeg", 6)
+	sos := bytes.Index(enc.Bytes(), []byte{0xff, 0xda})
+	if !bytes.HasSuffix(out, enc.Bytes()[sos:]) {
+		t.Error("image data from the start of scan on was changed")
+	}
+	want, _ := jpeg.Decode(bytes.NewReader(enc.Bytes()))
+	got, err := jpeg.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	samePixels(t, want, got)
+}
+
+func TestStripPNG(t *testing.T) {
+	var enc bytes.Buffer
+	if err := png.Encode(&enc, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	idat := bytes.Index(enc.Bytes(), []byte("IDAT")) - 4
+	var data []byte
+	data = append(data, enc.Bytes()[:idat]...)
+	data = append(data, pngChunk("tEXt", []byte("Comment\x00secret"))...)
+	data = append(data, pngChunk("eXIf", exifTIFF(3))...)
+	data = append(data, enc.Bytes()[idat:]...)
+
+	out := stripped(t, data, "image/png", 3)
+	if !bytes.HasSuffix(out, enc.Bytes()[idat:]) {
+		t.Error("image data from the first IDAT on was changed")
+	}
+	got, err := png.Decode(bytes.NewReader(out)) // checks every chunk's CRC
+	if err != nil {
+		t.Fatal(err)
+	}
+	samePixels(t, testImage(), got)
+}
+
+// losslessWebP is a 1x1 lossless WebP.
+const losslessWebP = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+
+func TestStripWebP(t *testing.T) {
+	simple, _ := base64.StdEncoding.DecodeString(losslessWebP)
+	vp8l := simple[12:]
+	le := binary.LittleEndian
+	chunk := func(kind string, body []byte) []byte {
+		out := append(le.AppendUint32([]byte(kind), uint32(len(body))), body...)
+		if len(body)%2 == 1 {
+			out = append(out, 0)
+		}
+		return out
+	}
+	const flagXMP, flagEXIF = 0x04, 0x08
+	var body []byte
+	body = append(body, "WEBP"...)
+	body = append(body, chunk("VP8X", []byte{flagXMP | flagEXIF, 0, 0, 0, 0, 0, 0, 0, 0, 0})...)
+	body = append(body, vp8l...)
+	body = append(body, chunk("EXIF", exifTIFF(8))...)
+	body = append(body, chunk("XMP ", []byte("<x:xmpmeta>secret</x:xmpmeta>"))...)
+	data := append(le.AppendUint32([]byte("RIFF"), uint32(len(body))), body...)
+
+	out := stripped(t, data, "image/webp", 8)
+	if got := le.Uint32(out[4:]); int(got) != len(out)-8 {
+		t.Errorf("RIFF size %d, want %d", got, len(out)-8)
+	}
+	if flags := out[20]; flags != flagEXIF {
+		t.Errorf("VP8X flags %#x, want only EXIF", flags)
+	}
+	if !bytes.Contains(out, vp8l) {
+		t.Error("VP8L chunk was changed")
+	}
+	want, _ := webp.Decode(bytes.NewReader(simple))
+	got, err := webp.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	samePixels(t, want, got)
+}
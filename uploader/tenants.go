@@ -0,0 +1,380 @@
+package uploader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ctxKey int
+
+const (
+	keyLabelCtx ctxKey = iota
+	requestInfoCtx
+)
+
+const defaultKeyLabel = "default"
+
+// apiKeys maps each accepted API key to the label identifying its client.
+var apiKeys = map[string]string{}
+
+var namespaceByKey bool
+
+var keyLabelPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+type QuotaStatus struct {
+	Label string `json:"label"`
+	Used  int64  `json:"used"`
+	Limit int64  `json:"limit"`
+	// ResetsAt is set for daily quotas.
+	ResetsAt *time.Time `json:"resets_at,omitempty"`
+}
+
+var quotas = struct {
+	sync.Mutex
+	limits map[string]int64
+	used   map[string]int64
+}{limits: map[string]int64{}, used: map[string]int64{}}
+
+func initAPIKeys() {
+	apiKeys[apiKey] = defaultKeyLabel
+	for _, entry := range envList("API_KEYS") {
+		label, key, ok := strings.Cut(entry, ":")
+		if !ok || label == "" || key == "" {
+			fatal("Invalid API_KEYS: entries must be label:key")
+		}
+		if !keyLabelPattern.MatchString(label) {
+			fatalf("Invalid API_KEYS: label %q may only contain letters, digits, - and _", label)
+		}
+		if _, dup := apiKeys[key]; dup {
+			fatalf("Invalid API_KEYS: key for %q is already in use", label)
+		}
+		apiKeys[key] = label
+	}
+	if file := getenv("API_KEYS_FILE"); file != "" {
+		loadTenants(file)
+	}
+}
+
+// Operations a tenant can be limited to. Keys without a list may do all of
+// them; the health check is always allowed.
+const (
+	opUpload = "upload"
+	opDelete = "delete"
+	opList   = "list"
+)
+
+// tenant holds the settings API_KEYS_FILE gives a label. Zero values fall
+// back to the global settings.
+type tenant struct {
+	prefix      string
+	operations  map[string]bool // nil allows everything
+	maxFileSize int64
+	maxFiles    int
+}
+
+// tenantConfig is one entry of API_KEYS_FILE.
+type tenantConfig struct {
+	Name            string   `json:"name"`
+	Key             string   `json:"key"`
+	Prefix          string   `json:"prefix"`
+	Operations      []string `json:"operations"`
+	MaxFileSizeMB   int      `json:"max_file_size_mb"`
+	MaxFiles        int      `json:"max_files"`
+	QuotaBytes      int64    `json:"quota_bytes"`
+	DailyQuotaBytes int64    `json:"daily_quota_bytes"`
+}
+
+var tenants = map[string]*tenant{}
+
+// tenantConfigs keeps the file's quotas until initQuotas and
+// initDailyQuotas merge them with the env settings.
+var tenantConfigs []tenantConfig
+
+var tenantPrefixPattern = regexp.MustCompile(`^([a-zA-Z0-9_.-]+/)+$`)
+
+func loadTenants(file string) {
+	f, err := os.Open(file)
+	if err != nil {
+		fatal("Invalid API_KEYS_FILE: ", err)
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&tenantConfigs); err != nil {
+		fatal("Invalid API_KEYS_FILE: must be a JSON array of tenants: ", err)
+	}
+	for _, cfg := range tenantConfigs {
+		if !keyLabelPattern.MatchString(cfg.Name) {
+			fatalf("Invalid API_KEYS_FILE: name %q may only contain letters, digits, - and _", cfg.Name)
+		}
+		if cfg.Key == "" {
+			fatalf("Invalid API_KEYS_FILE: %q has no key", cfg.Name)
+		}
+		if _, dup := apiKeys[cfg.Key]; dup {
+			fatalf("Invalid API_KEYS_FILE: key for %q is already in use", cfg.Name)
+		}
+		if tenants[cfg.Name] != nil {
+			fatalf("Invalid API_KEYS_FILE: %q is listed twice", cfg.Name)
+		}
+		t := &tenant{prefix: cfg.Prefix, maxFiles: cfg.MaxFiles, maxFileSize: int64(cfg.MaxFileSizeMB) << 20}
+		if cfg.Prefix != "" && (!tenantPrefixPattern.MatchString(cfg.Prefix) || path.Clean(cfg.Prefix)+"/" != cfg.Prefix ||
+			strings.HasPrefix(cfg.Prefix, aliasPrefix) || strings.HasPrefix(cfg.Prefix, trashPrefix)) {
+			fatalf("Invalid API_KEYS_FILE: prefix for %q must be a relative path ending in / outside %s and %s", cfg.Name, aliasPrefix, trashPrefix)
+		}
+		if cfg.Operations != nil {
+			t.operations = map[string]bool{}
+			for _, op := range cfg.Operations {
+				if op != opUpload && op != opDelete && op != opList {
+					fatalf("Invalid API_KEYS_FILE: operations for %q must be upload, delete or list", cfg.Name)
+				}
+				t.operations[op] = true
+			}
+		}
+		if cfg.MaxFileSizeMB < 0 || cfg.MaxFileSizeMB > 5120 || cfg.MaxFiles < 0 || cfg.MaxFiles > 100 {
+			fatalf("Invalid API_KEYS_FILE: limits for %q must be max_file_size_mb 1-5120 and max_files 1-100", cfg.Name)
+		}
+		if cfg.QuotaBytes < 0 || cfg.DailyQuotaBytes < 0 {
+			fatalf("Invalid API_KEYS_FILE: quotas for %q must be positive", cfg.Name)
+		}
+		apiKeys[cfg.Key] = cfg.Name
+		tenants[cfg.Name] = t
+	}
+
+	// Own prefixes must not overlap, or one tenant could list and delete
+	// another's objects. One inside the shared uploads/ is fine: ownsKey
+	// keeps the keys sharing it out.
+	for a, ta := range tenants {
+		for b, tb := range tenants {
+			if a != b && ta.prefix != "" && tb.prefix != "" && strings.HasPrefix(ta.prefix, tb.prefix) {
+				fatalf("Invalid API_KEYS_FILE: prefix of %q is inside the prefix of %q", a, b)
+			}
+		}
+	}
+	log.Printf("🔑 Loaded %d tenant(s) from %s", len(tenantConfigs), file)
+}
+
+// allowOperation answers 403 and returns false when the caller's key may
+// not perform op.
+func allowOperation(w http.ResponseWriter, r *http.Request, op string) bool {
+	t := tenants[keyLabel(r)]
+	if t == nil || t.operations == nil || t.operations[op] {
+		return true
+	}
+	sendJSONMulti(w, 403, nil, nil, "Forbidden: this API key may not "+op)
+	return false
+}
+
+// uploadLimitsFor returns label's per-file size limit and files per request.
+func uploadLimitsFor(label string) (int64, int) {
+	size, count := maxFileSize, maxFiles
+	if t := tenants[label]; t != nil {
+		if t.maxFileSize > 0 {
+			size = t.maxFileSize
+		}
+		if t.maxFiles > 0 {
+			count = t.maxFiles
+		}
+	}
+	return size, count
+}
+
+// tenantQuotas returns the quotas API_KEYS_FILE sets, by label, for daily
+// or storage quotas.
+func tenantQuotas(daily bool) map[string]int64 {
+	limits := map[string]int64{}
+	for _, cfg := range tenantConfigs {
+		n := cfg.QuotaBytes
+		if daily {
+			n = cfg.DailyQuotaBytes
+		}
+		if n > 0 {
+			limits[cfg.Name] = n
+		}
+	}
+	return limits
+}
+
+func initQuotas() {
+	labels := map[string]bool{}
+	for _, label := range apiKeys {
+		labels[label] = true
+	}
+	quotas.limits = tenantQuotas(false)
+	for _, entry := range envList("KEY_QUOTAS") {
+		label, limit, ok := strings.Cut(entry, ":")
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if !ok || err != nil || n < 1 {
+			fatal("Invalid KEY_QUOTAS: entries must be label:maxBytes")
+		}
+		if !labels[label] {
+			fatalf("Invalid KEY_QUOTAS: unknown key label %q", label)
+		}
+		quotas.limits[label] = n
+	}
+	seedQuotaUsage()
+}
+
+// sidePrefixFor is where label keeps objects of a kind clients can't write
+// directly, such as aliases or trash: beside the uploads/ segment of its
+// prefix, or under the kind's own prefix when a tenant prefix doesn't end
+// in uploads/.
+func sidePrefixFor(label, kind string) string {
+	prefix := uploadPrefixFor(label)
+	if root, ok := strings.CutSuffix(prefix, uploadPrefix); ok {
+		return root + kind
+	}
+	return kind + prefix
+}
+
+// ownsPrefix reports whether label's objects live under a prefix no other
+// label uses.
+func ownsPrefix(label string) bool {
+	if t := tenants[label]; t != nil && t.prefix != "" {
+		return true
+	}
+	return namespaceByKey
+}
+
+// seedQuotaUsage counts what each tenant already stores, which is only
+// possible when objects live under per-tenant prefixes.
+func seedQuotaUsage() {
+	for label := range quotas.limits {
+		if !ownsPrefix(label) {
+			continue
+		}
+		var used int64
+		err := scanObjects(context.Background(), uploadPrefixFor(label), func(obj StoredObject) {
+			used += obj.Size
+		})
+		if err != nil {
+			fatalf("Failed to scan existing usage for %q: %v", label, err)
+		}
+		quotas.used[label] = used
+		log.Printf("📦 Quota usage for %s: %d of %d bytes", label, used, quotas.limits[label])
+	}
+}
+
+// uploadPrefixFor returns the key prefix new uploads and prefix-guarded
+// operations use for label.
+func uploadPrefixFor(label string) string {
+	if t := tenants[label]; t != nil && t.prefix != "" {
+		return t.prefix
+	}
+	if namespaceByKey {
+		return label + "/" + uploadPrefix
+	}
+	return uploadPrefix
+}
+
+// scanPrefix is where bucket-wide admin scans start: the shared upload
+// prefix, or the whole bucket when objects are namespaced per tenant.
+func scanPrefix() string {
+	if namespaceByKey {
+		return ""
+	}
+	for _, t := range tenants {
+		if t.prefix != "" && !strings.HasPrefix(t.prefix, uploadPrefix) {
+			return ""
+		}
+	}
+	return uploadPrefix
+}
+
+// ownsKey reports whether key is a plain object key under label's upload
+// prefix. Keys under another tenant's prefix are not, even when that prefix
+// is nested inside label's, such as uploads/mobile/ inside the shared
+// uploads/.
+func ownsKey(label, key string) bool {
+	return isManagedKey(uploadPrefixFor(label), key) && !inOtherTenant(label, key)
+}
+
+// inOtherTenant reports whether key lies under the prefix, aliases or trash
+// of a tenant other than label. Tenant prefixes don't overlap, so such a key
+// is never label's.
+func inOtherTenant(label, key string) bool {
+	for name, t := range tenants {
+		if name == label || t.prefix == "" {
+			continue
+		}
+		for _, prefix := range []string{t.prefix, sidePrefixFor(name, aliasPrefix), trashRootFor(name)} {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isUploadKey(key string) bool {
+	for _, t := range tenants {
+		if t.prefix != "" && strings.HasPrefix(key, t.prefix) {
+			return true
+		}
+	}
+	if !namespaceByKey {
+		return strings.HasPrefix(key, uploadPrefix)
+	}
+	label, rest, ok := strings.Cut(key, "/")
+	return ok && keyLabelPattern.MatchString(label) && strings.HasPrefix(rest, uploadPrefix)
+}
+
+func withKeyLabel(r *http.Request, label string) *http.Request {
+	if info := requestInfoFrom(r); info != nil {
+		info.keyLabel = label
+	}
+	return r.WithContext(context.WithValue(r.Context(), keyLabelCtx, label))
+}
+
+func keyLabel(r *http.Request) string {
+	if label, ok := r.Context().Value(keyLabelCtx).(string); ok {
+		return label
+	}
+	return defaultKeyLabel
+}
+
+// reserveQuota claims n bytes of label's budget before uploading so that
+// concurrent requests can't jointly overshoot it. Unused bytes must be handed
+// back with releaseQuota.
+func reserveQuota(label string, n int64) (*QuotaStatus, error) {
+	quotas.Lock()
+	defer quotas.Unlock()
+	limit, ok := quotas.limits[label]
+	if !ok {
+		return nil, nil
+	}
+	used := quotas.used[label]
+	if used+n > limit {
+		status := &QuotaStatus{Label: label, Used: used, Limit: limit}
+		return status, fmt.Errorf("Storage quota exceeded: %d of %d bytes used", used, limit)
+	}
+	quotas.used[label] = used + n
+	return nil, nil
+}
+
+func hasQuota(label string) bool {
+	quotas.Lock()
+	defer quotas.Unlock()
+	_, ok := quotas.limits[label]
+	return ok
+}
+
+func releaseQuota(label string, n int64) {
+	if n == 0 {
+		return
+	}
+	quotas.Lock()
+	defer quotas.Unlock()
+	if _, ok := quotas.limits[label]; ok {
+		quotas.used[label] = max(0, quotas.used[label]-n)
+	}
+}
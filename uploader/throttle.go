@@ -0,0 +1,68 @@
+package uploader
+
+import (
+	"context"
+	"io"
+	"strconv"
+
+	"golang.org/x/time/rate"
+)
+
+// uploadLimiter is shared by every in-flight upload, so the cap applies to
+// the aggregate bytes sent to R2 rather than to each request separately.
+var uploadLimiter *rate.Limiter
+
+const throttleChunk = 64 << 10
+
+func initThrottle() {
+	v := getenv("MAX_UPLOAD_BANDWIDTH_MBPS")
+	if v == "" {
+		return
+	}
+	mbps, err := strconv.ParseFloat(v, 64)
+	if err != nil || mbps <= 0 {
+		fatal("Invalid MAX_UPLOAD_BANDWIDTH_MBPS: must be a positive number")
+	}
+	bytesPerSec := mbps * 1_000_000 / 8
+	burst := max(throttleChunk, int(bytesPerSec))
+	uploadLimiter = rate.NewLimiter(rate.Limit(bytesPerSec), burst)
+}
+
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func throttle(ctx context.Context, r io.Reader) io.Reader {
+	if uploadLimiter == nil {
+		return r
+	}
+	if rs, ok := r.(io.ReadSeeker); ok {
+		return &throttledReadSeeker{throttledReader{ctx, rs}, rs}
+	}
+	return &throttledReader{ctx, r}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := uploadLimiter.WaitN(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// throttledReadSeeker keeps the body seekable so the SDK can still rewind
+// it for retries.
+type throttledReadSeeker struct {
+	throttledReader
+	s io.Seeker
+}
+
+func (t *throttledReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return t.s.Seek(offset, whence)
+}
@@ -0,0 +1,107 @@
+package uploader
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCertFiles, tlsKeyFiles []string
+var tlsCertificates atomic.Pointer[[]tls.Certificate]
+
+// loadTLSConfig loads every cert/key pair up front so a bad path or a
+// mismatched key fails at startup instead of on the first handshake.
+// Multiple pairs are served by SNI.
+func loadTLSConfig(certFiles, keyFiles string) *tls.Config {
+	tlsCertFiles = strings.Split(certFiles, ",")
+	tlsKeyFiles = strings.Split(keyFiles, ",")
+	if len(tlsCertFiles) != len(tlsKeyFiles) {
+		fatal("Invalid TLS config: TLS_CERT_FILE and TLS_KEY_FILE must list the same number of files")
+	}
+	certs, err := loadCertificates()
+	if err != nil {
+		fatal(err)
+	}
+	tlsCertificates.Store(&certs)
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: getCertificate}
+
+	if v := getenv("TLS_MIN_VERSION"); v != "" {
+		version, ok := tlsVersions[v]
+		if !ok {
+			fatal("Invalid TLS_MIN_VERSION: must be 1.0, 1.1, 1.2 or 1.3")
+		}
+		cfg.MinVersion = version
+	}
+
+	if names := envList("TLS_CIPHER_SUITES"); len(names) > 0 {
+		suites := map[string]uint16{}
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range names {
+			id, ok := suites[name]
+			if !ok {
+				fatalf("Invalid TLS_CIPHER_SUITES: unknown or insecure suite %q", name)
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+		if cfg.MinVersion == tls.VersionTLS13 {
+			log.Println("⚠️  TLS_CIPHER_SUITES has no effect with TLS_MIN_VERSION=1.3")
+		}
+	}
+
+	return cfg
+}
+
+func loadCertificates() ([]tls.Certificate, error) {
+	var certs []tls.Certificate
+	for i := range tlsCertFiles {
+		cert, err := tls.LoadX509KeyPair(strings.TrimSpace(tlsCertFiles[i]), strings.TrimSpace(tlsKeyFiles[i]))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load TLS certificate %s: %v", tlsCertFiles[i], err)
+		}
+		if cert.Leaf != nil && time.Now().After(cert.Leaf.NotAfter) {
+			return nil, fmt.Errorf("TLS certificate %s expired on %s", tlsCertFiles[i], cert.Leaf.NotAfter.Format(time.RFC3339))
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// getCertificate picks the current certificate for each handshake, so a
+// reload takes effect for new connections without restarting the listener.
+func getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs := *tlsCertificates.Load()
+	for i := range certs {
+		if hello.SupportsCertificate(&certs[i]) == nil {
+			return &certs[i], nil
+		}
+	}
+	return &certs[0], nil
+}
+
+// reloadCertificates re-reads the cert/key files and only swaps them in if
+// every pair loads, so a half-written renewal keeps the old certs serving.
+func reloadCertificates() {
+	if tlsCertificates.Load() == nil {
+		return
+	}
+	certs, err := loadCertificates()
+	if err != nil {
+		log.Println("TLS reload failed, keeping current certificates:", err)
+		return
+	}
+	tlsCertificates.Store(&certs)
+	log.Printf("🔄 TLS certificates reloaded (%d)", len(certs))
+}
@@ -0,0 +1,234 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const trashPrefix = "trash/"
+
+var softDelete bool
+var trashRetention = 7 * 24 * time.Hour
+var trashSweepInterval = time.Hour
+
+var errNoObject = errors.New("object not found")
+var errRestoreQuota = errors.New("Storage quota exceeded")
+
+func initTrash(s *Server) {
+	softDelete = envBool("SOFT_DELETE")
+	trashRetention = envDuration("TRASH_RETENTION", trashRetention)
+	trashSweepInterval = envDuration("TRASH_SWEEP_INTERVAL", trashSweepInterval)
+	if softDelete && trashSweepInterval > 0 {
+		s.background.Go(func() { sweepTrash(s.ctx) })
+	}
+}
+
+// trashRootFor is where label's deleted objects wait, next to its upload
+// prefix like aliases. Uploads, folders and delete keys are all confined to
+// the upload prefix, so clients can't write here directly.
+func trashRootFor(label string) string {
+	return sidePrefixFor(label, trashPrefix)
+}
+
+// trashKeyFor keeps the whole upload key under the trash root, so
+// uploads/a.jpg becomes trash/uploads/a.jpg and restoring is a prefix swap.
+func trashKeyFor(label, key string) string {
+	prefix := uploadPrefixFor(label)
+	if root, ok := strings.CutSuffix(prefix, uploadPrefix); ok {
+		return trashRootFor(label) + strings.TrimPrefix(key, root)
+	}
+	return trashRootFor(label) + strings.TrimPrefix(key, prefix)
+}
+
+// restoreHandler moves objects deleted under SOFT_DELETE back to their
+// original keys. It takes the same key parameter or URL list as /delete.
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) || !allowOperation(w, r, opDelete) {
+		return
+	}
+
+	items, keys, ok := requestedKeys(w, r)
+	if !ok {
+		return
+	}
+
+	var restored, failed []string
+	missing := 0
+	for i, key := range keys {
+		ctx, cancel := withOptionalTimeout(r.Context(), deleteTimeout)
+		err := restoreObject(ctx, keyLabel(r), key)
+		cancel()
+		switch {
+		case err == nil:
+			restored = append(restored, items[i])
+		case errors.Is(err, errNoObject):
+			missing++
+			failed = append(failed, items[i]+": Not in trash")
+		case errors.Is(err, errRestoreQuota):
+			failed = append(failed, items[i]+": "+err.Error())
+		case errors.Is(err, context.DeadlineExceeded):
+			failed = append(failed, items[i]+": Restore timed out")
+		default:
+			log.Println("Restore failed for", key+":", err)
+			failed = append(failed, items[i]+": Restore failed")
+		}
+	}
+
+	switch {
+	case len(restored) == 0 && missing == len(keys):
+		sendJSONMulti(w, 404, nil, failed, "Nothing to restore")
+	case len(restored) == 0:
+		sendJSONMulti(w, 502, nil, failed, "All restores failed")
+	case len(failed) > 0:
+		sendJSONMulti(w, 207, restored, failed, fmt.Sprintf("%d of %d objects restored", len(restored), len(keys)))
+	default:
+		sendJSONMulti(w, 200, restored, nil, fmt.Sprintf("%d object(s) restored", len(restored)))
+	}
+}
+
+// trashObjects is /delete under SOFT_DELETE. There is no batch copy, so each
+// key is moved on its own, deleteConcurrency at a time. errs[i] is nil,
+// errNoObject or the failure for keys[i].
+func trashObjects(ctx context.Context, label string, keys []string) []error {
+	errs := make([]error, len(keys))
+	runBounded(len(keys), deleteConcurrency, func(i int) {
+		keyCtx, cancel := withOptionalTimeout(ctx, deleteTimeout)
+		defer cancel()
+		errs[i] = trashObject(keyCtx, label, keys[i])
+	})
+	return errs
+}
+
+// trashObject moves key to the trash. A trashed object no longer counts
+// against the quota, the same as a deleted one.
+func trashObject(ctx context.Context, label, key string) error {
+	size, err := moveObject(ctx, key, trashKeyFor(label, key))
+	if err != nil {
+		return err
+	}
+	releaseQuota(label, size)
+	return nil
+}
+
+// restoreObject moves key back out of the trash. Under a quota the bytes are
+// reserved first, so a restore can be refused like an upload.
+func restoreObject(ctx context.Context, label, key string) error {
+	trashKey := trashKeyFor(label, key)
+	var size int64
+	if hasQuota(label) {
+		head, err := routeRead(func(store Storage) (StoredObject, error) {
+			return store.Head(ctx, trashKey)
+		})
+		if isNotFound(err) {
+			return errNoObject
+		}
+		if err != nil {
+			return err
+		}
+		size = head.Size
+		if _, err := reserveQuota(label, size); err != nil {
+			return errRestoreQuota
+		}
+	}
+	if _, err := moveObject(ctx, trashKey, key); err != nil {
+		releaseQuota(label, size)
+		return err
+	}
+	return nil
+}
+
+// moveObject copies from to to and removes from, on every backend that has
+// it; with a fallback, a failed-over object lives there instead of on R2. The
+// copy keeps the headers and metadata, and its LastModified is when it was
+// moved, which is what the sweeper goes by. It returns the object's size, or
+// errNoObject when no backend has it.
+func moveObject(ctx context.Context, from, to string) (int64, error) {
+	var size int64
+	moved := false
+	moveOn := func(store Storage) error {
+		head, err := store.Head(ctx, from)
+		if isNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := store.Copy(ctx, from, to, nil); err != nil {
+			return err
+		}
+		if err := store.Delete(ctx, from); err != nil {
+			return err
+		}
+		size, moved = head.Size, true
+		return nil
+	}
+
+	if err := moveOn(storage); err != nil {
+		return 0, err
+	}
+	if fallback != nil {
+		if err := moveOn(fallback.Storage); err != nil {
+			return 0, err
+		}
+	}
+	if !moved {
+		return 0, errNoObject
+	}
+	return size, nil
+}
+
+func sweepTrash(ctx context.Context) {
+	for {
+		purgeTrash(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(trashSweepInterval):
+		}
+	}
+}
+
+// purgeTrash permanently deletes objects that have been in every tenant's
+// trash for longer than TRASH_RETENTION.
+func purgeTrash(ctx context.Context) {
+	roots := map[string]bool{}
+	for _, label := range apiKeys {
+		roots[trashRootFor(label)] = true
+	}
+	cutoff := time.Now().Add(-trashRetention)
+
+	purge := func(name string, store Storage) {
+		purged := 0
+		for root := range roots {
+			var expired []string
+			err := store.Scan(ctx, root, func(obj StoredObject) {
+				if obj.LastModified.Before(cutoff) {
+					expired = append(expired, obj.Key)
+				}
+			})
+			if err != nil {
+				log.Printf("Trash sweep of %s (%s) failed: %v", name, root, err)
+				continue
+			}
+			for _, key := range expired {
+				if err := store.Delete(ctx, key); err != nil {
+					logStorageError("DeleteObject", key, err)
+					continue
+				}
+				purged++
+			}
+		}
+		if purged > 0 {
+			log.Printf("🗑️  Purged %d object(s) from the %s trash", purged, name)
+		}
+	}
+	purge("R2", storage)
+	if fallback != nil {
+		purge("fallback", fallback.Storage)
+	}
+}
@@ -0,0 +1,63 @@
+package uploader
+
+import (
+	"sort"
+	"strings"
+)
+
+// imageTypes lists the extensions ALLOWED_EXTENSIONS may enable: those whose
+// content the sniffer can confirm.
+var imageTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".webp": "image/webp",
+	".gif":  "image/gif",
+	".avif": "image/avif",
+}
+
+var maxFiles = 5
+
+var allowedExtensions = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".webp": true}
+
+// allowedTypes mirrors allowedExtensions as MIME types, for checking sniffed
+// content.
+var allowedTypes = map[string]bool{"image/jpeg": true, "image/png": true, "image/webp": true}
+
+func initFileTypes() {
+	// MAX_FILES is the older name, still read when the new one isn't set.
+	if maxFiles = envInt("MAX_FILES_PER_REQUEST", envInt("MAX_FILES", maxFiles)); maxFiles > 100 {
+		fatal("Invalid MAX_FILES_PER_REQUEST: must be between 1 and 100")
+	}
+
+	exts := envList("ALLOWED_EXTENSIONS")
+	if len(exts) == 0 {
+		return
+	}
+	allowedExtensions = map[string]bool{}
+	allowedTypes = map[string]bool{}
+	for _, ext := range exts {
+		ext = "." + strings.TrimPrefix(strings.ToLower(ext), ".")
+		contentType, ok := imageTypes[ext]
+		if !ok {
+			fatalf("Invalid ALLOWED_EXTENSIONS: unsupported extension %s; use %s", ext, extensionList(imageTypes))
+		}
+		allowedExtensions[ext] = true
+		allowedTypes[contentType] = true
+	}
+}
+
+// allowedExtensionList is the allowlist as shown in error messages, e.g.
+// "jpeg, jpg, png, webp".
+func allowedExtensionList() string {
+	return extensionList(allowedExtensions)
+}
+
+func extensionList[V any](exts map[string]V) string {
+	names := make([]string, 0, len(exts))
+	for ext := range exts {
+		names = append(names, strings.TrimPrefix(ext, "."))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,238 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// blockingS3 accepts the first fastPuts PutObject calls and holds every
+// later one until the client gives up on it.
+type blockingS3 struct {
+	mu       sync.Mutex
+	fastPuts int
+	puts     []string
+	deletes  []string
+	blocked  chan struct{}
+	release  chan struct{}
+}
+
+func (f *blockingS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	f.mu.Lock()
+	switch r.Method {
+	case http.MethodPut:
+		f.puts = append(f.puts, key)
+		fast := len(f.puts) <= f.fastPuts
+		f.mu.Unlock()
+		if !fast {
+			// The server only notices the client hanging up once the body
+			// has been read.
+			io.Copy(io.Discard, r.Body)
+			f.blocked <- struct{}{}
+			select {
+			case <-r.Context().Done():
+			case <-f.release:
+			}
+		}
+		return
+	case http.MethodHead:
+		w.WriteHeader(http.StatusNotFound)
+	case http.MethodDelete:
+		f.deletes = append(f.deletes, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+	f.mu.Unlock()
+}
+
+func useBlockingS3(t *testing.T, fastPuts int) *blockingS3 {
+	t.Helper()
+	f := &blockingS3{fastPuts: fastPuts, blocked: make(chan struct{}, 10), release: make(chan struct{})}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(f.release) })
+
+	oldStorage, oldURL, oldConcurrency := storage, publicURL, uploadConcurrency
+	t.Cleanup(func() {
+		storage, publicURL, uploadConcurrency = oldStorage, oldURL, oldConcurrency
+	})
+	client := s3.New(s3.Options{
+		Region:       "auto",
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("id", "secret", ""),
+	})
+	publicURL = "https://cdn.example.com"
+	storage = newS3Storage(client, "bucket", publicURL)
+	uploadConcurrency = 1
+	return f
+}
+
+func multipartPNGs(t *testing.T, n int) (*bytes.Buffer, string) {
+	t.Helper()
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i := range n {
+		part, err := mw.CreateFormFile("images", "photo"+string(rune('a'+i))+".png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(img.Bytes())
+	}
+	mw.Close()
+	return &body, mw.FormDataContentType()
+}
+
+// uploadUntilBlocked starts a 3-file upload, waits for a PutObject to hang,
+// then disconnects the client and returns the response.
+func uploadUntilBlocked(t *testing.T, f *blockingS3) ApiResponse {
+	t.Helper()
+	body, contentType := multipartPNGs(t, 3)
+	ctx, disconnect := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/upload", body).WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		uploadHandler(rec, req)
+		close(done)
+	}()
+	select {
+	case <-f.blocked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no upload reached storage")
+	}
+	disconnect()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler still running after the client disconnected")
+	}
+
+	var resp ApiResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding response %q: %v", rec.Body.String(), err)
+	}
+	return resp
+}
+
+func TestUploadStopsWhenClientDisconnects(t *testing.T) {
+	f := useBlockingS3(t, 0)
+	resp := uploadUntilBlocked(t, f)
+
+	f.mu.Lock()
+	puts := len(f.puts)
+	f.mu.Unlock()
+	if puts != 1 {
+		t.Errorf("storage saw %d PutObject calls, want 1: files after the disconnect should not start", puts)
+	}
+	if len(resp.URLs) != 0 {
+		t.Errorf("urls = %v, want none", resp.URLs)
+	}
+	if len(resp.Retry) != 3 {
+		t.Fatalf("retry = %+v, want 3 entries", resp.Retry)
+	}
+	for _, entry := range resp.Retry {
+		if entry.Reason != reasonCanceled || !entry.Retryable {
+			t.Errorf("file %d: reason %q (retryable %v), want retryable %q", entry.Index, entry.Reason, entry.Retryable, reasonCanceled)
+		}
+	}
+}
+
+func TestCanceledUploadCleanup(t *testing.T) {
+	for _, cleanup := range []bool{false, true} {
+		f := useBlockingS3(t, 1)
+		cleanupCanceledUploads = cleanup
+		resp := uploadUntilBlocked(t, f)
+		cleanupCanceledUploads = false
+
+		if len(resp.URLs) != 1 {
+			t.Fatalf("cleanup=%v: urls = %v, want the file stored before the disconnect", cleanup, resp.URLs)
+		}
+		f.mu.Lock()
+		stored, deletes := f.puts[0], f.deletes
+		f.mu.Unlock()
+		switch {
+		case cleanup && (len(deletes) != 1 || deletes[0] != stored):
+			t.Errorf("cleanup=true: deleted %v, want [%s]", deletes, stored)
+		case !cleanup && len(deletes) != 0:
+			t.Errorf("cleanup=false: deleted %v, want nothing", deletes)
+		}
+	}
+}
+
+func TestS3CopyEscapesSource(t *testing.T) {
+	var source string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		source = r.Header.Get("X-Amz-Copy-Source")
+		io.WriteString(w, `<CopyObjectResult><ETag>"x"</ETag></CopyObjectResult>`)
+	}))
+	defer srv.Close()
+	client := s3.New(s3.Options{
+		Region:       "auto",
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("id", "secret", ""),
+	})
+	store := newS3Storage(client, "bucket", "https://cdn.example.com")
+
+	key := "uploads/my photos/a+b?c%d#1.png"
+	if err := store.Copy(context.Background(), key, "aliases/x.png", nil); err != nil {
+		t.Fatal(err)
+	}
+	bucket, escaped, _ := strings.Cut(source, "/")
+	if got, err := url.PathUnescape(escaped); bucket != "bucket" || err != nil || got != key {
+		t.Errorf("copy source %q names %q in %q, want %q in bucket", source, got, bucket, key)
+	}
+	if strings.ContainsAny(escaped, " ?#") {
+		t.Errorf("copy source %q is not escaped", source)
+	}
+}
+
+func TestS3ListCursorIsLastKey(t *testing.T) {
+	var startAfter string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startAfter = r.URL.Query().Get("start-after")
+		io.WriteString(w, `<ListBucketResult><IsTruncated>true</IsTruncated><NextContinuationToken>opaque</NextContinuationToken>`+
+			`<Contents><Key>uploads/b.png</Key><Size>1</Size></Contents><Contents><Key>uploads/c.png</Key><Size>1</Size></Contents></ListBucketResult>`)
+	}))
+	defer srv.Close()
+	client := s3.New(s3.Options{
+		Region:       "auto",
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("id", "secret", ""),
+	})
+	store := newS3Storage(client, "bucket", "https://cdn.example.com")
+
+	page, err := store.List(context.Background(), "uploads/", "uploads/a.png", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if startAfter != "uploads/a.png" {
+		t.Errorf("start-after %q, want the cursor", startAfter)
+	}
+	if page.NextCursor != "uploads/c.png" {
+		t.Errorf("next cursor %q, want the page's last key", page.NextCursor)
+	}
+}
@@ -0,0 +1,1377 @@
+// Package uploader is the image upload service: multipart and raw uploads to
+// Cloudflare R2, S3-compatible or local storage, with listing, deletion and
+// the admin endpoints. Everything is configured through the environment
+// variables in the README, or through Config.
+package uploader
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type ApiResponse struct {
+	Status  int      `json:"status"`
+	URLs    []string `json:"urls"`
+	Message string   `json:"message"`
+	Failed  []string `json:"failed,omitempty"`
+	// NotFound lists the /delete items that were already gone.
+	NotFound []string     `json:"not_found,omitempty"`
+	Retry    []RetryEntry `json:"retry,omitempty"`
+	Files    []FileResult `json:"files,omitempty"`
+	Batch    *BatchStats  `json:"batch,omitempty"`
+	Dedup    *DedupStats  `json:"dedup,omitempty"`
+	Quota    *QuotaStatus `json:"quota,omitempty"`
+	Receipt  *Receipt     `json:"receipt,omitempty"`
+}
+
+type FileResult struct {
+	Original     string `json:"original"`
+	Key          string `json:"key"`
+	URL          string `json:"url"`
+	CanonicalURL string `json:"canonical_url,omitempty"`
+	AliasURL     string `json:"alias_url,omitempty"`
+	AliasError   string `json:"alias_error,omitempty"`
+	Size         int64  `json:"size"`
+	ContentType  string `json:"content_type"`
+	// Width, Height and Format come from the image header; AVIF has no
+	// decoder here and leaves them out.
+	Width         int     `json:"width,omitempty"`
+	Height        int     `json:"height,omitempty"`
+	Format        string  `json:"format,omitempty"`
+	OriginalSize  int64   `json:"original_size"`
+	StoredSize    int64   `json:"stored_size"`
+	DurationMs    int64   `json:"duration_ms"`
+	ThroughputBps float64 `json:"throughput_bps"`
+	ColorModel    string  `json:"color_model,omitempty"`
+	HasAlpha      *bool   `json:"has_alpha,omitempty"`
+	Grayscale     *bool   `json:"grayscale,omitempty"`
+	BitDepth      int     `json:"bit_depth,omitempty"`
+	MD5           string  `json:"md5,omitempty"`
+	DeclaredType  string  `json:"declared_type,omitempty"`
+	DetectedType  string  `json:"detected_type,omitempty"`
+	// ImageMetadata is set when EXTRACT_METADATA is on.
+	ImageMetadata *ImageMetadata `json:"image_metadata,omitempty"`
+	// Partial marks a file stored without the optional steps listed in
+	// SkippedSteps, because PROCESSING_BUDGET ran out.
+	Partial      bool     `json:"partial,omitempty"`
+	SkippedSteps []string `json:"skipped_steps,omitempty"`
+	// RelativeURL and AbsoluteURL are verbose-only: the object's path under
+	// the public base, and url again, so clients needn't build either.
+	RelativeURL string `json:"relative_url,omitempty"`
+	AbsoluteURL string `json:"absolute_url,omitempty"`
+	// Variants maps each ?variants= name to its URL. A variant that couldn't
+	// be made leaves the rest out, and VariantError says why.
+	Variants     map[string]string `json:"variants,omitempty"`
+	VariantError string            `json:"variant_error,omitempty"`
+	// VariantQuality is set under TARGET_FILE_SIZE_KB, by variant name, for
+	// the JPEG variants.
+	VariantQuality map[string]TunedVariant `json:"variant_quality,omitempty"`
+	// Deduplicated means the content was already stored under Key, so
+	// nothing was uploaded and URL is the existing object's.
+	Deduplicated bool `json:"deduplicated,omitempty"`
+}
+
+// TunedVariant is the JPEG quality TARGET_FILE_SIZE_KB settled on for a
+// variant and the size it came to; TargetMet is false when no quality
+// tried fit.
+type TunedVariant struct {
+	Quality   int   `json:"quality"`
+	Size      int64 `json:"size"`
+	TargetMet bool  `json:"target_met"`
+}
+
+type BatchStats struct {
+	Bytes         int64   `json:"bytes"`
+	OriginalBytes int64   `json:"original_bytes"`
+	StoredBytes   int64   `json:"stored_bytes"`
+	SavedBytes    int64   `json:"saved_bytes"`
+	DurationMs    int64   `json:"duration_ms"`
+	ThroughputBps float64 `json:"throughput_bps"`
+}
+
+// DedupStats counts an /upload batch's files by whether deduplication found
+// them already stored. BytesSaved is what the deduplicated files would have
+// added to storage.
+type DedupStats struct {
+	UploadedNew  int   `json:"uploaded_new"`
+	Deduplicated int   `json:"deduplicated"`
+	BytesSaved   int64 `json:"bytes_saved"`
+}
+
+// RetryEntry tells a client which file of the original request failed and
+// whether resubmitting it could succeed.
+type RetryEntry struct {
+	Index     int    `json:"index"`
+	Filename  string `json:"filename"`
+	Reason    string `json:"reason"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+}
+
+const (
+	reasonInvalidType  = "invalid_type"
+	reasonTypeDisabled = "type_disabled"
+	reasonOpenFailed   = "open_failed"
+	reasonUploadFailed = "upload_failed"
+	reasonUnavailable  = "storage_unavailable"
+	reasonTimeout      = "timeout"
+	reasonSuspicious   = "suspicious_content"
+	reasonDimensions   = "dimensions_exceeded"
+	reasonTooLarge     = "file_too_large"
+	reasonTooSmall     = "file_too_small"
+	reasonCanceled     = "canceled"
+)
+
+// serverReasons are failures caused by the service or R2 rather than by the
+// submitted file; they decide the status when every file in a batch fails.
+var serverReasons = map[string]bool{
+	reasonOpenFailed:   true,
+	reasonUploadFailed: true,
+	reasonUnavailable:  true,
+	reasonTimeout:      true,
+}
+
+var allFailedClientStatus = 422
+var allFailedServerStatus = 502
+
+var retryableReasons = map[string]bool{
+	reasonOpenFailed:   true,
+	reasonUploadFailed: true,
+	reasonUnavailable:  true,
+	reasonTimeout:      true,
+	reasonCanceled:     true,
+}
+
+var uploadTimeout = 60 * time.Second
+var batchTimeout = 5 * time.Minute
+var deleteTimeout = 30 * time.Second
+var uploadConcurrency = 3
+var cleanupCanceledUploads bool
+
+type HealthResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+var privateBucket bool
+var presignExpiry = time.Hour
+var publicURL string
+var apiKey string
+var adminKey string
+var allowKeyInQuery bool
+
+var keyShardLength int
+
+var maxFileSize int64 = 10 << 20 // 10MB
+var minFileSize int64
+
+// multipartOverhead covers boundaries, part headers and the non-file fields.
+const multipartOverhead = 1 << 20
+
+const uploadPrefix = "uploads/"
+
+// Config is what New needs beyond the environment. Zero fields fall back to
+// the matching environment variable, so New(Config{}) behaves like the
+// standalone service.
+type Config struct {
+	APIKey      string // API_KEY
+	AdminAPIKey string // ADMIN_API_KEY
+	// Storage replaces the backend STORAGE_BACKEND would set up. PublicURL is
+	// then the prefix /delete accepts URLs under.
+	Storage        Storage
+	PublicURL      string
+	MaxFileSizeMB  int      // MAX_FILE_SIZE_MB
+	MaxFiles       int      // MAX_FILES_PER_REQUEST
+	AllowedOrigins []string // CORS_ALLOWED_ORIGINS
+	// Settings sets any other variable from the README by name, taking
+	// precedence over the process environment.
+	Settings map[string]string
+}
+
+// Server is the upload service as an http.Handler. It can be mounted under
+// any prefix with http.StripPrefix, or run on its own with Run.
+type Server struct {
+	handler http.Handler
+	// Shutdown cancels ctx to stop the background work, such as the trash
+	// sweeper, that background waits for; done is closed once it has.
+	ctx        context.Context
+	stop       context.CancelFunc
+	done       chan struct{}
+	background sync.WaitGroup
+	shutdown   sync.Once
+	async      *asyncPool
+	webhooks   *webhookQueue
+}
+
+type serverKey struct{}
+
+// serverFrom returns the Server handling r, or nil for a request that
+// didn't come through Server.ServeHTTP.
+func serverFrom(r *http.Request) *Server {
+	s, _ := r.Context().Value(serverKey{}).(*Server)
+	return s
+}
+
+// New validates cfg and the environment and builds the routes. Settings are
+// package state, so a process runs one Server at a time: New fails while an
+// earlier Server hasn't finished Shutdown.
+func New(cfg Config) (s *Server, err error) {
+	active.Lock()
+	defer active.Unlock()
+	if active.server != nil {
+		return nil, errServerActive
+	}
+	defer recoverConfigError(&err)
+
+	s = &Server{done: make(chan struct{})}
+	s.ctx, s.stop = context.WithCancel(context.Background())
+	resetState()
+	settings = map[string]string{}
+	for name, v := range cfg.Settings {
+		settings[name] = v
+	}
+	typed := map[string]string{"API_KEY": cfg.APIKey, "ADMIN_API_KEY": cfg.AdminAPIKey}
+	if cfg.MaxFileSizeMB > 0 {
+		typed["MAX_FILE_SIZE_MB"] = strconv.Itoa(cfg.MaxFileSizeMB)
+	}
+	if cfg.MaxFiles > 0 {
+		typed["MAX_FILES_PER_REQUEST"] = strconv.Itoa(cfg.MaxFiles)
+	}
+	if len(cfg.AllowedOrigins) > 0 {
+		typed["CORS_ALLOWED_ORIGINS"] = strings.Join(cfg.AllowedOrigins, ",")
+	}
+	for name, v := range typed {
+		if v != "" {
+			settings[name] = v
+		}
+	}
+
+	initLogging()
+	initRetry()
+	if cfg.Storage != nil {
+		storage = cfg.Storage
+		publicURL = strings.TrimSuffix(cfg.PublicURL, "/")
+	} else {
+		initStorage()
+	}
+	initFallback()
+	initResponseCase()
+
+	apiKey = getenv("API_KEY")
+	if apiKey == "" {
+		fatal("Missing required environment variable: API_KEY")
+	}
+	initAPIKeys()
+	if allowKeyInQuery = envBool("ALLOW_KEY_IN_QUERY"); allowKeyInQuery {
+		log.Println("⚠️  ALLOW_KEY_IN_QUERY is on: API keys sent as ?api_key= end up in access logs, proxy logs and browser history")
+	}
+	namespaceByKey = envBool("NAMESPACE_BY_KEY")
+	initQuotas()
+	initDailyQuotas()
+	initRateLimit()
+	adminKey = getenv("ADMIN_API_KEY")
+
+	initStats()
+	if name := getenv("DEFAULT_FILENAME"); name != "" {
+		if strings.ContainsAny(name, `/\.`) {
+			fatal("Invalid DEFAULT_FILENAME: must be a base name without extension or slashes")
+		}
+		defaultBaseName = name
+	}
+	if envBool("KEY_SHARDING") {
+		keyShardLength = envInt("KEY_SHARD_LENGTH", 2)
+		if keyShardLength > 8 {
+			fatal("Invalid KEY_SHARD_LENGTH: must be between 1 and 8")
+		}
+	}
+	if mb := envInt("MAX_FILE_SIZE_MB", int(maxFileSize>>20)); mb <= 5120 {
+		maxFileSize = int64(mb) << 20
+	} else {
+		fatal("Invalid MAX_FILE_SIZE_MB: must be between 1 and 5120")
+	}
+	minFileSize = int64(envIntMin("MIN_FILE_SIZE_BYTES", 0, 0))
+	if minFileSize > maxFileSize {
+		fatal("Invalid MIN_FILE_SIZE_BYTES: must not exceed MAX_FILE_SIZE_MB")
+	}
+	allFailedClientStatus = envStatus("ALL_FAILED_CLIENT_STATUS", allFailedClientStatus)
+	allFailedServerStatus = envStatus("ALL_FAILED_SERVER_STATUS", allFailedServerStatus)
+	uploadTimeout = envDuration("UPLOAD_TIMEOUT", uploadTimeout)
+	batchTimeout = envDuration("BATCH_TIMEOUT", batchTimeout)
+	deleteTimeout = envDuration("DELETE_TIMEOUT", deleteTimeout)
+	initDelete()
+	initServerTimeouts()
+	initMultipart()
+	initTrash(s)
+	initPresign()
+	uploadConcurrency = envInt("UPLOAD_CONCURRENCY", uploadConcurrency)
+	cleanupCanceledUploads = envBool("CLEANUP_CANCELED_UPLOADS")
+	initProcessingBudget()
+	initFileTypes()
+	initSlug()
+	initKeyStrategy()
+	initDedupe()
+	initAliases()
+	initUploadFields()
+	initProgress()
+	s.async = initAsync()
+	initMetadataSchema()
+	initZip()
+	initThrottle()
+	initDimensions()
+	initDecodePool()
+	initVariants()
+	initIPLimit()
+	initEntropyCheck()
+	contentMD5 = envBool("CONTENT_MD5")
+	polyglotCheck = envBool("POLYGLOT_CHECK")
+	extractMetadata = envBool("EXTRACT_METADATA")
+	stripExif = envBool("STRIP_EXIF")
+	logUploadSizes = envBool("LOG_UPLOAD_SIZES")
+	logTypeCorrections = envBool("LOG_TYPE_CORRECTIONS")
+	initReceipts()
+	s.webhooks = initWebhooks()
+	initBreaker()
+	initMetrics()
+	loadDisabledTypes()
+
+	initCORS()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", authMiddleware(healthHandler))
+	mux.HandleFunc("/upload", authMiddleware(uploadHandler))
+	mux.HandleFunc("/upload/raw", authMiddleware(rawUploadHandler))
+	mux.HandleFunc("/delete", authMiddleware(deleteHandler))
+	mux.HandleFunc("/images", authMiddleware(imagesHandler))
+	mux.HandleFunc("/images/", authMiddleware(imagesHandler))
+	mux.HandleFunc("/download-zip", authMiddleware(downloadZipHandler))
+	mux.HandleFunc("/progress/", authMiddleware(progressHandler))
+	mux.HandleFunc("/jobs/", authMiddleware(jobHandler))
+	if localFiles != nil {
+		mux.Handle(localFilesPath, localFiles)
+	}
+	if presignedUploads {
+		mux.HandleFunc("/presign", authMiddleware(presignHandler))
+	}
+	if softDelete {
+		mux.HandleFunc("/restore", authMiddleware(restoreHandler))
+	}
+	if receiptAlgorithm == receiptEd25519 {
+		mux.HandleFunc("/pubkey", pubkeyHandler)
+	}
+	if metricsEnabled {
+		mux.HandleFunc("/metrics", metricsHandler)
+	}
+	if adminKey != "" {
+		mux.HandleFunc("/stats", adminMiddleware(statsHandler))
+		mux.HandleFunc("/stats/largest", adminMiddleware(largestObjectsHandler))
+	}
+
+	var handler http.Handler = mux
+	if maxRequestsPerIP > 0 {
+		handler = ipLimitMiddleware(handler)
+	}
+	s.handler = requestLogMiddleware(corsMiddleware(negotiateMiddleware(handler)))
+	active.server = s
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), serverKey{}, s)))
+}
+
+// Shutdown waits until queued async uploads are stored, queued webhooks are
+// sent and the background work has stopped, or ctx is done. Call it after
+// the http.Server serving s has shut down, so no new work arrives. Once it
+// has returned nil the package is back at its defaults, and New may build
+// the next Server.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdown.Do(func() {
+		s.stop()
+		s.background.Go(func() {
+			// Async jobs send webhooks, so they have to be done first.
+			s.async.drain()
+			s.webhooks.drain()
+		})
+		go func() {
+			s.background.Wait()
+			active.Lock()
+			resetState()
+			active.server = nil
+			active.Unlock()
+			close(s.done)
+		}()
+	})
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		// Stop waiting on webhook retries; queued async uploads still finish.
+		if s.webhooks != nil {
+			s.webhooks.abort()
+		}
+		return ctx.Err()
+	}
+}
+
+// Run serves s on PORT, over HTTPS when TLS_CERT_FILE and TLS_KEY_FILE are
+// set, reloads on SIGHUP and shuts down gracefully on SIGINT or SIGTERM.
+func (s *Server) Run() (err error) {
+	defer recoverConfigError(&err)
+
+	port := getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	certFile := getenv("TLS_CERT_FILE")
+	keyFile := getenv("TLS_KEY_FILE")
+
+	server := newServer(":"+port, s)
+	if certFile != "" && keyFile != "" {
+		server.TLSConfig = loadTLSConfig(certFile, keyFile)
+	}
+
+	shutdownTimeout = envDuration("SHUTDOWN_TIMEOUT", shutdownTimeout)
+	if envBool("WARMUP_ON_START") {
+		warmUp()
+	}
+	watchReload(s)
+
+	errs := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			log.Println("🚀 Server running on port", port, "(HTTPS)")
+			errs <- server.ListenAndServeTLS("", "")
+		} else {
+			log.Println("🚀 Server running on port", port, "(HTTP)")
+			errs <- server.ListenAndServe()
+		}
+	}()
+	return waitForShutdown(server, s, errs)
+}
+
+func recoverConfigError(err *error) {
+	if v := recover(); v != nil {
+		cerr, ok := v.(configError)
+		if !ok {
+			panic(v)
+		}
+		*err = cerr
+	}
+}
+
+func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The IP limit comes first so that guessing keys is limited too.
+		if rateLimited(w, ipRateLimits, clientIP(r)) {
+			return
+		}
+		key := r.Header.Get("X-API-Key")
+		if key == "" && allowKeyInQuery {
+			key = r.URL.Query().Get("api_key")
+		}
+		label, ok := apiKeys[key]
+		if !ok {
+			sendJSON(w, 401, map[string]interface{}{
+				"status":  401,
+				"message": "Unauthorized: Invalid or missing API key",
+			})
+			return
+		}
+		if rateLimited(w, keyRateLimits, label) {
+			return
+		}
+		next(w, withKeyLabel(r, label))
+	}
+}
+
+func adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// An unset key refuses everything, so a request without the header
+		// can't match it.
+		if adminKey == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("X-API-Key")), []byte(adminKey)) != 1 {
+			sendJSON(w, 401, map[string]interface{}{
+				"status":  401,
+				"message": "Unauthorized: Admin API key required",
+			})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	sendJSON(w, 200, HealthResponse{
+		Success: true,
+		Message: "successfully connect",
+	})
+}
+
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) || !allowOperation(w, r, opUpload) {
+		return
+	}
+
+	sizeLimit, fileLimit := uploadLimitsFor(keyLabel(r))
+	budget := int64(fileLimit) * sizeLimit
+	r.Body = http.MaxBytesReader(w, r.Body, budget+multipartOverhead)
+	form, err := readUploadForm(r, sizeLimit, fileLimit)
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		sendJSONMulti(w, 413, nil, nil, fmt.Sprintf("Request exceeds %dMB limit (%d files of %dMB)", (budget+multipartOverhead)>>20, fileLimit, sizeLimit>>20))
+		return
+	}
+	if errors.Is(err, errTooManyFiles) {
+		sendJSONMulti(w, 400, nil, nil, fmt.Sprintf("Maximum %d images allowed", fileLimit))
+		return
+	}
+	if err != nil {
+		sendJSONMulti(w, 400, nil, nil, "Invalid multipart form")
+		return
+	}
+	// An async job keeps the temp files after the handler returns.
+	queued := false
+	defer func() {
+		if !queued {
+			removeForm(form)
+		}
+	}()
+
+	files, err := collectUploadFiles(form)
+	if err != nil {
+		sendJSONMulti(w, 400, nil, nil, err.Error())
+		return
+	}
+	if len(files) == 0 {
+		sendJSONMulti(w, 400, nil, nil, "At least 1 image required")
+		return
+	}
+	if logUploadSizes {
+		sizes := make([]int64, len(files))
+		for i, fileHeader := range files {
+			sizes[i] = fileHeader.Size
+		}
+		logRequestSizes(r, sizes)
+	}
+	if len(files) > fileLimit {
+		sendJSONMulti(w, 400, nil, nil, fmt.Sprintf("Maximum %d images allowed", fileLimit))
+		return
+	}
+
+	if wait := uploadBreaker.retryAfter(); wait > 0 && fallback == nil {
+		sendUnavailable(w, wait)
+		return
+	}
+
+	meta, err := parseMetadata(r.FormValue("metadata"))
+	if err != nil {
+		sendJSONMulti(w, 400, nil, nil, "Invalid metadata: "+err.Error())
+		return
+	}
+
+	label := keyLabel(r)
+	logicalID := r.FormValue("logical_id")
+	withAlias := aliasesEnabled && logicalID != ""
+	if withAlias && len(files) != 1 {
+		sendJSONMulti(w, 400, nil, nil, "logical_id requires exactly 1 image")
+		return
+	}
+	if _, err := aliasKeyFor(label, logicalID, ""); err != nil {
+		sendJSONMulti(w, 400, nil, nil, err.Error())
+		return
+	}
+	if usesLogicalID() && logicalID != "" {
+		if err := checkLogicalID(logicalID); err != nil {
+			sendJSONMulti(w, 400, nil, nil, err.Error())
+			return
+		}
+	}
+	folder := r.FormValue("folder")
+	if folder == "" {
+		folder = r.Header.Get("X-Upload-Prefix")
+	}
+	folder, err = uploadFolder(label, folder)
+	if err != nil {
+		sendJSONMulti(w, 400, nil, nil, err.Error())
+		return
+	}
+	variants, err := parseVariants(r.FormValue("variants"))
+	if err != nil {
+		sendJSONMulti(w, 400, nil, nil, err.Error())
+		return
+	}
+	variantExt, err := parseConvert(r.FormValue("convert"))
+	if err != nil {
+		sendJSONMulti(w, 400, nil, nil, err.Error())
+		return
+	}
+	if variantExt != "" && len(variants) == 0 {
+		sendJSONMulti(w, 400, nil, nil, "convert requires variants")
+		return
+	}
+	dedupe, err := parseDedupe(r.FormValue("dedupe"))
+	if err != nil {
+		sendJSONMulti(w, 400, nil, nil, err.Error())
+		return
+	}
+
+	async, err := parseAsync(r.FormValue("async"))
+	if err != nil {
+		sendJSONMulti(w, 400, nil, nil, err.Error())
+		return
+	}
+
+	// An async job is polled at /jobs/{id} instead.
+	var progress *uploadProgress
+	if !async {
+		progress, err = startProgress(w, r, label, len(files))
+		if errors.Is(err, errProgressTokenInUse) {
+			sendJSONMulti(w, 409, nil, nil, err.Error())
+			return
+		}
+		if err != nil {
+			sendJSONMulti(w, 400, nil, nil, err.Error())
+			return
+		}
+		defer progress.finish()
+	}
+
+	prefix := uploadPrefixFor(label) + folder
+	// Files over the limit fail on their own in uploadFile and store nothing,
+	// so they don't count against the quota.
+	var reserved int64
+	for _, fileHeader := range files {
+		if !fileHeader.dropped && fileHeader.Size <= sizeLimit {
+			reserved += fileHeader.Size
+		}
+	}
+	if quota, err := reserveDailyQuota(label, reserved); err != nil {
+		sendDailyQuotaExceeded(w, quota, err)
+		return
+	}
+	if quota, err := reserveQuota(label, reserved); err != nil {
+		releaseDailyQuota(label, reserved)
+		sendResponse(w, ApiResponse{Status: 507, Message: err.Error(), Quota: quota})
+		return
+	}
+
+	job := &uploadJob{
+		r:          r,
+		label:      label,
+		prefix:     prefix,
+		logicalID:  logicalID,
+		meta:       meta,
+		variants:   variants,
+		variantExt: variantExt,
+		verbose:    isVerbose(r),
+		progress:   progress,
+		sizeLimit:  sizeLimit,
+		dedupe:     dedupe,
+	}
+	if async {
+		queued = enqueueUpload(w, job, form, files, reserved)
+		return
+	}
+
+	// Each file gets its own deadline nested inside the batch deadline, so one
+	// slow file can time out alone while the batch as a whole stays bounded.
+	batchCtx, cancel := withOptionalTimeout(r.Context(), batchTimeout)
+	defer cancel()
+	job.ctx = batchCtx
+	resp := job.run(files, reserved)
+	if resp.Status == 200 && len(files) == 1 {
+		w.Header().Set("Location", resp.URLs[0])
+	}
+	sendResponse(w, resp)
+}
+
+func removeForm(form *uploadForm) {
+	if err := form.RemoveAll(); err != nil {
+		log.Println("Failed to remove multipart temp files:", err)
+	}
+}
+
+// run uploads a batch and builds its response. reserved is the quota the
+// handler claimed for it; whatever the stored files didn't use is released.
+func (job *uploadJob) run(files []*formFile, reserved int64) ApiResponse {
+	label, dedupe := job.label, job.dedupe
+	withFiles := job.verbose || wantsFiles(job.r) || len(job.variants) > 0
+	withAlias := aliasesEnabled && job.logicalID != ""
+	batchStart := time.Now()
+
+	// Files upload concurrently, but each outcome lands at its input index,
+	// so urls, failed and files keep the request's order.
+	outcomes := make([]fileOutcome, len(files))
+	slots := make(chan struct{}, uploadConcurrency)
+	var wg sync.WaitGroup
+	for i, fileHeader := range files {
+		slots <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-slots }()
+			job.status.startFile(i)
+			outcomes[i] = job.uploadFile(i, fileHeader)
+			job.status.finishFile(i, outcomes[i])
+		})
+	}
+	wg.Wait()
+	if cleanupCanceledUploads && errors.Is(job.ctx.Err(), context.Canceled) {
+		job.discard(outcomes)
+	}
+
+	var urls []string
+	var failed []string
+	var retry []RetryEntry
+	var results []FileResult
+	var receiptFiles []ReceiptFile
+	var hookFiles []WebhookFile
+	var batchBytes, originalBytes, dedupedBytes, strippedBytes int64
+	var dedupStats DedupStats
+	for _, outcome := range outcomes {
+		if f := outcome.failure; f != nil {
+			failed = append(failed, f.Filename+": "+f.Message)
+			retry = append(retry, *f)
+			continue
+		}
+		res := outcome.result
+		urls = append(urls, res.URL)
+		batchBytes += res.StoredSize
+		originalBytes += res.OriginalSize
+		reserved -= res.OriginalSize
+		if res.Deduplicated {
+			dedupedBytes += res.OriginalSize
+			dedupStats.Deduplicated++
+			dedupStats.BytesSaved += res.StoredSize
+		} else {
+			dedupStats.UploadedNew++
+			strippedBytes += res.OriginalSize - res.StoredSize
+		}
+		if withFiles || contentMD5 || withAlias || extractMetadata || stripExif || dedupe {
+			results = append(results, res)
+		}
+		if receiptsEnabled() {
+			receiptFiles = append(receiptFiles, ReceiptFile{Key: res.Key, Size: res.StoredSize, SHA256: outcome.sha256})
+		}
+		if s := serverFrom(job.r); s != nil && s.webhooks != nil {
+			hookFiles = append(hookFiles, WebhookFile{Key: res.Key, URL: res.URL, Size: res.StoredSize, ContentType: res.ContentType, Deduplicated: res.Deduplicated})
+		}
+	}
+	notifyUpload(job.r, label, hookFiles)
+
+	// A deduplicated file stores nothing new, and a stripped one less than
+	// was sent, but the daily quota counts what was sent.
+	releaseQuota(label, reserved+dedupedBytes+strippedBytes)
+	releaseDailyQuota(label, reserved)
+
+	resp := ApiResponse{URLs: urls, Failed: failed, Retry: retry, Files: results}
+	if len(receiptFiles) > 0 {
+		var err error
+		if resp.Receipt, err = signReceipt(label, receiptFiles); err != nil {
+			log.Println("Failed to sign receipt:", err)
+		}
+	}
+	if dedupe {
+		resp.Dedup = &dedupStats
+	}
+	if job.verbose {
+		elapsed := time.Since(batchStart)
+		resp.Batch = &BatchStats{
+			Bytes:         batchBytes,
+			OriginalBytes: originalBytes,
+			StoredBytes:   batchBytes,
+			SavedBytes:    originalBytes - batchBytes,
+			DurationMs:    elapsed.Milliseconds(),
+			ThroughputBps: throughput(batchBytes, elapsed),
+		}
+	}
+
+	switch {
+	case len(urls) == 0:
+		resp.Status = allFailedStatus(retry)
+		resp.Message = "All uploads failed"
+	case len(failed) > 0:
+		resp.Status = 207
+		resp.Message = fmt.Sprintf("%d of %d images uploaded", len(urls), len(files))
+	default:
+		resp.Status = 200
+		resp.Message = fmt.Sprintf("%d image(s) uploaded successfully", len(urls))
+	}
+	return resp
+}
+
+// uploadJob holds what every file of one /upload request shares.
+type uploadJob struct {
+	ctx        context.Context // batch deadline
+	r          *http.Request
+	label      string
+	prefix     string
+	logicalID  string
+	meta       map[string]string
+	variants   []variantSpec
+	variantExt string // from ?convert=, or "" for the default
+	verbose    bool
+	progress   *uploadProgress
+	status     *asyncJob // set for ?async=true
+	sizeLimit  int64     // per file, from uploadLimitsFor
+	dedupe     bool
+}
+
+// fileOutcome is either a stored file or the reason it was rejected.
+type fileOutcome struct {
+	result      FileResult
+	sha256      string
+	variantKeys []string
+	failure     *RetryEntry
+}
+
+// uploadFile validates and stores one file. It is safe to run concurrently
+// with the batch's other files, and a panic fails only this file.
+func (job *uploadJob) uploadFile(i int, fileHeader *formFile) (outcome fileOutcome) {
+	fail := func(reason, message string) fileOutcome {
+		job.progress.record(false, 0)
+		recordUploadFailure(reason)
+		return fileOutcome{failure: &RetryEntry{
+			Index:     i,
+			Filename:  fileHeader.Filename,
+			Reason:    reason,
+			Message:   message,
+			Retryable: retryableReasons[reason],
+		}}
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Upload of %s panicked: %v\n%s", fileHeader.Filename, p, debug.Stack())
+			outcome = fail(reasonUploadFailed, "Upload failed")
+		}
+	}()
+
+	if job.ctx.Err() != nil {
+		return fail(job.stopped())
+	}
+	budget := newFileBudget()
+	if fileHeader.Size > job.sizeLimit {
+		return fail(reasonTooLarge, fmt.Sprintf("exceeds %dMB limit", job.sizeLimit>>20))
+	}
+	if fileHeader.Size < minFileSize {
+		return fail(reasonTooSmall, fmt.Sprintf("below %d byte minimum", minFileSize))
+	}
+
+	name := fileHeader.Filename
+	if filepath.Ext(name) == "" {
+		if ext, ok := sniffExtension(fileHeader); ok {
+			name += ext
+			recordTypeCorrection(job.r, "", detectContentType(name))
+		}
+	}
+	if !isAllowedImage(name) {
+		return fail(reasonInvalidType, "Invalid type (allowed: "+allowedExtensionList()+")")
+	}
+	if contentType := detectContentType(name); isTypeDisabled(contentType) {
+		return fail(reasonTypeDisabled, "Type "+contentType+" is temporarily disabled")
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return fail(reasonOpenFailed, "Failed to open")
+	}
+	defer file.Close()
+
+	// A form file always seeks, whether the part is held in memory or was
+	// spilled to a temp file, so each check rewinds rather than buffers.
+	contentType, err := verifyContentType(file, name)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	var mismatch *typeMismatchError
+	switch {
+	case errors.As(err, &mismatch):
+		return fail(reasonInvalidType, "Content is "+mismatch.detected+", not "+mismatch.declared+" as the extension claims")
+	case errors.Is(err, errNotImage):
+		return fail(reasonInvalidType, "Content is not an allowed image type ("+allowedExtensionList()+")")
+	case err != nil:
+		return fail(reasonOpenFailed, "Failed to open")
+	}
+
+	if entropyCheck {
+		suspicious, err := looksEncrypted(file)
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			return fail(reasonOpenFailed, "Failed to open")
+		}
+		if suspicious {
+			return fail(reasonSuspicious, "Content looks encrypted, not like an image")
+		}
+	}
+
+	if polyglotCheck {
+		finding, err := detectPolyglot(file)
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			return fail(reasonOpenFailed, "Failed to open")
+		}
+		if finding != "" {
+			return fail(reasonSuspicious, "Content is not a clean image: "+finding)
+		}
+	}
+
+	var header image.Config
+	var imageFormat string
+	if needsHeaderCheck(contentType) {
+		header, imageFormat, err = checkDimensions(job.ctx, file)
+		if _, seekErr := file.Seek(0, io.SeekStart); seekErr != nil {
+			return fail(reasonOpenFailed, "Failed to open")
+		}
+		var dimErr *dimensionError
+		switch {
+		case errors.As(err, &dimErr):
+			return fail(reasonDimensions, "Image "+dimErr.Error())
+		case errors.Is(err, errDecodeBusy), errors.Is(err, context.DeadlineExceeded):
+			return fail(reasonTimeout, "Timed out reading the image header")
+		case err != nil:
+			return fail(reasonInvalidType, "Unreadable image")
+		}
+	}
+
+	// Metadata is read before STRIP_EXIF removes it, so the client still
+	// learns what the file carried.
+	var imageMeta *ImageMetadata
+	if extractMetadata && budget.allow("metadata") {
+		imageMeta = readImageMetadata(job.ctx, file)
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fail(reasonOpenFailed, "Failed to open")
+		}
+	}
+
+	// storedSize diverges from fileHeader.Size once a step rewrites the bytes.
+	storedSize := fileHeader.Size
+	var body io.ReadSeeker = file
+	if stripExif {
+		stripped, err := stripMetadata(file, fileHeader.Size, contentType)
+		if errors.Is(err, errStripFailed) {
+			return fail(reasonInvalidType, "Unreadable image")
+		}
+		if err != nil {
+			return fail(reasonOpenFailed, "Failed to open")
+		}
+		body, storedSize = stripped, stripped.Size()
+	}
+
+	var digests fileDigests
+	if hashingEnabled() || job.dedupe {
+		digests, err = digestFile(body)
+		if err == nil {
+			_, err = body.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			return fail(reasonOpenFailed, "Failed to open")
+		}
+	}
+
+	var format ImageFormat
+	if job.verbose && budget.allow("format") {
+		format, _ = inspectImage(job.ctx, body)
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return fail(reasonOpenFailed, "Failed to open")
+		}
+	}
+
+	// The checks above can take a while; don't start a PutObject nobody
+	// will wait for.
+	if job.ctx.Err() != nil {
+		return fail(job.stopped())
+	}
+
+	keyInput := KeyInput{Original: name, SHA256: digests.SHA256Hex, LogicalID: job.logicalID, Now: time.Now()}
+	filename := generateFileName(strategyPrefix(job.label, job.prefix), keyInput)
+	start := time.Now()
+	fileCtx, cancelFile := withOptionalTimeout(job.ctx, uploadTimeout)
+	var url string
+	var deduplicated bool
+	if job.dedupe {
+		filename = dedupeFileName(job.label, job.prefix, keyInput)
+		url, deduplicated = existingURL(fileCtx, filename)
+	}
+	if !deduplicated {
+		url, err = uploadToR2(fileCtx, body, storedSize, filename, UploadOptions{Metadata: job.meta, ContentMD5: digests.MD5Base64, ContentType: contentType})
+	}
+	cancelFile()
+	elapsed := time.Since(start)
+
+	if errors.Is(err, errCircuitOpen) {
+		return fail(reasonUnavailable, "Storage temporarily unavailable")
+	}
+	if errors.Is(err, context.Canceled) && job.ctx.Err() != nil {
+		return fail(job.stopped())
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fail(reasonTimeout, "Upload timed out")
+	}
+	if err != nil {
+		return fail(reasonUploadFailed, "Upload failed")
+	}
+	if !deduplicated {
+		recordUpload(elapsed)
+	}
+
+	var aliasURL, aliasError string
+	derivatives := 0
+	if aliasKey, _ := aliasKeyFor(job.label, job.logicalID, name); aliasKey != "" {
+		derivatives++
+		if aliasURL, err = updateAlias(job.ctx, filename, aliasKey, job.meta); err != nil {
+			log.Println("Alias update failed for", aliasKey+":", err)
+			aliasError = "Alias update failed"
+		}
+	}
+
+	var variantURLs map[string]string
+	var variantKeys []string
+	var variantQuality map[string]TunedVariant
+	var variantError string
+	variants := job.variants
+	if room := maxDerivatives - derivatives; len(variants) > room {
+		var skipped []string
+		for _, spec := range variants[room:] {
+			skipped = append(skipped, spec.name)
+		}
+		variants = variants[:room]
+		log.Printf("MAX_DERIVATIVES (%d) trimmed variants %s of %s", maxDerivatives, strings.Join(skipped, ", "), filename)
+		variantError = fmt.Sprintf("At most %d derivatives per image; %s not made", maxDerivatives, strings.Join(skipped, ", "))
+	}
+	if len(variants) > 0 && budget.allow("variants") {
+		_, err := body.Seek(0, io.SeekStart)
+		if err == nil {
+			variantURLs, variantKeys, variantQuality, err = job.storeVariants(body, filename, contentType, variants)
+		}
+		switch {
+		case errors.Is(err, errVariantQuota), errors.Is(err, errVariantDailyQuota), errors.Is(err, errDecodePixels):
+			variantError = err.Error()
+		case err != nil:
+			log.Println("Variants failed for", filename+":", err)
+			variantError = "Variant generation failed"
+		}
+	}
+
+	job.progress.record(true, storedSize)
+	var relativeURL, absoluteURL string
+	if job.verbose {
+		relativeURL, absoluteURL = "/"+filename, url
+	}
+	return fileOutcome{
+		result: FileResult{
+			Original:       fileHeader.Filename,
+			Key:            filename,
+			URL:            url,
+			CanonicalURL:   canonicalURL(url),
+			RelativeURL:    relativeURL,
+			AbsoluteURL:    absoluteURL,
+			AliasURL:       aliasURL,
+			AliasError:     aliasError,
+			Variants:       variantURLs,
+			VariantQuality: variantQuality,
+			VariantError:   variantError,
+			Deduplicated:   deduplicated,
+			Size:           storedSize,
+			ContentType:    contentType,
+			Width:          header.Width,
+			Height:         header.Height,
+			Format:         imageFormat,
+			OriginalSize:   fileHeader.Size,
+			StoredSize:     storedSize,
+			DurationMs:     elapsed.Milliseconds(),
+			ThroughputBps:  throughput(storedSize, elapsed),
+			ColorModel:     format.ColorModel,
+			HasAlpha:       format.HasAlpha,
+			Grayscale:      format.Grayscale,
+			BitDepth:       format.BitDepth,
+			MD5:            digests.MD5Hex,
+			ImageMetadata:  imageMeta,
+			Partial:        len(budget.skipped) > 0,
+			SkippedSteps:   budget.skipped,
+		},
+		sha256:      digests.SHA256Hex,
+		variantKeys: variantKeys,
+	}
+}
+
+// stopped says why the batch context ended: the client disconnected, or the
+// batch deadline passed.
+func (job *uploadJob) stopped() (reason, message string) {
+	if errors.Is(job.ctx.Err(), context.Canceled) {
+		return reasonCanceled, "Request canceled"
+	}
+	return reasonTimeout, "Batch timeout exceeded"
+}
+
+// discard removes what a batch stored before its client went away. Nobody
+// received those URLs, so with CLEANUP_CANCELED_UPLOADS they aren't kept.
+// The request context is done, so each delete gets its own.
+func (job *uploadJob) discard(outcomes []fileOutcome) {
+	for _, outcome := range outcomes {
+		// A deduplicated key belongs to an earlier upload too.
+		if outcome.failure != nil || outcome.result.Deduplicated {
+			continue
+		}
+		for _, key := range append([]string{outcome.result.Key}, outcome.variantKeys...) {
+			ctx, cancel := withOptionalTimeout(context.Background(), deleteTimeout)
+			if err := purgeObject(ctx, job.label, key); err != nil {
+				logStorageError("DeleteObject", key, err)
+			}
+			cancel()
+		}
+	}
+}
+
+func withOptionalTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func allFailedStatus(failures []RetryEntry) int {
+	for _, f := range failures {
+		if serverReasons[f.Reason] {
+			return allFailedServerStatus
+		}
+	}
+	return allFailedClientStatus
+}
+
+func sendUnavailable(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(max(wait, time.Second).Seconds()))))
+	sendJSONMulti(w, 503, nil, nil, "Storage temporarily unavailable, retry later")
+}
+
+// allowMethod reports whether r uses method, the one the endpoint serves.
+// HEAD counts as GET, and net/http drops the body. On other endpoints HEAD
+// gets an empty 200, so uptime monitors can probe them, and any other method
+// gets 405. Both carry an Allow header.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method || (r.Method == http.MethodHead && method == http.MethodGet) {
+		return true
+	}
+	if method == http.MethodGet {
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+	} else {
+		w.Header().Set("Allow", method+", HEAD, OPTIONS")
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return false
+	}
+	sendJSON(w, 405, map[string]interface{}{"status": 405, "message": "Method not allowed"})
+	return false
+}
+
+func isVerbose(r *http.Request) bool {
+	verbose, _ := strconv.ParseBool(r.URL.Query().Get("verbose"))
+	return verbose
+}
+
+// wantsFiles reports whether the client asked for the per-file entries
+// with ?files=true, without the rest of the verbose details.
+func wantsFiles(r *http.Request) bool {
+	files, _ := strconv.ParseBool(r.URL.Query().Get("files"))
+	return files
+}
+
+func throughput(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) / elapsed.Seconds()
+}
+
+func isAllowedImage(filename string) bool {
+	return allowedExtensions[strings.ToLower(filepath.Ext(filename))]
+}
+
+var folderPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+(/[A-Za-z0-9_-]+)*$`)
+
+var errFolder = errors.New("Invalid folder: use letters, digits, - and _, optionally in /-separated segments, up to 200 characters")
+var errFolderTenant = errors.New("Invalid folder: inside another tenant's prefix")
+
+// uploadFolder validates a client-chosen folder and returns it ready to
+// append to the upload prefix. Dots and empty segments are never allowed, so
+// a folder can't climb out of uploads/.
+func uploadFolder(label, folder string) (string, error) {
+	if folder == "" {
+		return "", nil
+	}
+	folder = strings.TrimSuffix(folder, "/")
+	if len(folder) > 200 || !folderPattern.MatchString(folder) {
+		return "", errFolder
+	}
+	if inOtherTenant(label, uploadPrefixFor(label)+folder+"/") {
+		return "", errFolderTenant
+	}
+	return folder + "/", nil
+}
+
+func generateFileName(prefix string, in KeyInput) string {
+	return shardedKey(prefix, keyStrategy.Key(in))
+}
+
+func shardedKey(prefix, name string) string {
+	if keyShardLength > 0 {
+		sum := sha256.Sum256([]byte(name))
+		name = hex.EncodeToString(sum[:])[:keyShardLength] + "/" + name
+	}
+	return prefix + name
+}
+
+type UploadOptions struct {
+	Metadata   map[string]string
+	ContentMD5 string // base64, as the header requires
+	// ContentType overrides the type implied by the key's extension.
+	ContentType string
+}
+
+func uploadToR2(ctx context.Context, body io.Reader, size int64, filename string, opts UploadOptions) (string, error) {
+	url, err := putToR2(ctx, body, size, filename, opts)
+	backend := "primary"
+	if err != nil && canFailOver(err, body) {
+		log.Println("R2 upload failed, writing", filename, "to fallback backend:", err)
+		url, err = fallback.upload(ctx, body, size, filename, opts)
+		backend = "fallback"
+	}
+	if err == nil {
+		uploadSizes.record(size)
+		storageBytes.add(labels("backend", backend), float64(size))
+	}
+	return url, err
+}
+
+func putToR2(ctx context.Context, body io.Reader, size int64, filename string, opts UploadOptions) (string, error) {
+	if !uploadBreaker.allow() {
+		return "", errCircuitOpen
+	}
+	err := storage.Put(ctx, filename, throttle(ctx, body), size, opts)
+	uploadBreaker.record(err)
+	if err != nil {
+		logStorageError("PutObject", filename, err)
+		return "", err
+	}
+
+	return objectURL(ctx, filename)
+}
+
+func putObjectInput(bucket string, body io.Reader, size int64, filename string, opts UploadOptions) *s3.PutObjectInput {
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(bucket),
+		Key:           aws.String(filename),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+		ContentType:   aws.String(detectContentType(filename)),
+		Metadata:      opts.Metadata,
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	if opts.ContentMD5 != "" {
+		input.ContentMD5 = aws.String(opts.ContentMD5)
+	}
+	return input
+}
+
+// objectURL returns the URL clients should use to fetch key from the
+// primary store.
+func objectURL(ctx context.Context, key string) (string, error) {
+	return storage.PublicURL(ctx, key)
+}
+
+// canonicalURL returns url when it is a permanent public URL. Keys are never
+// reused, so that URL always serves the same bytes. Presigned URLs expire and
+// have no canonical form.
+func canonicalURL(url string) string {
+	if !privateBucket && publicURL != "" && strings.HasPrefix(url, publicURL+"/") {
+		return url
+	}
+	if fallback != nil && fallback.publicURL != "" && strings.HasPrefix(url, fallback.publicURL+"/") {
+		return url
+	}
+	return ""
+}
+
+// detectContentType maps an extension to its MIME type, trusting the built-in
+// image table over the system's mime.types, which varies between hosts.
+func detectContentType(filename string) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if contentType, ok := imageTypes[ext]; ok {
+		return contentType
+	}
+	if contentType, _, err := mime.ParseMediaType(mime.TypeByExtension(ext)); err == nil {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+func sendJSONMulti(w http.ResponseWriter, status int, urls []string, failed []string, message string) {
+	sendResponse(w, ApiResponse{
+		Status:  status,
+		URLs:    urls,
+		Message: message,
+		Failed:  failed,
+	})
+}
+
+func sendResponse(w http.ResponseWriter, resp ApiResponse) {
+	sendJSON(w, resp.Status, resp)
+}
+
+func sendJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Add("Vary", "Accept")
+	_, useMsgpack := w.(*negotiatedWriter)
+	if !camelCaseFields && !useMsgpack {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println("Failed to encode response:", err)
+		w.WriteHeader(500)
+		return
+	}
+	if camelCaseFields {
+		data = camelizeKeys(data)
+	}
+	if useMsgpack {
+		if data, err = encodeMsgpack(data); err != nil {
+			log.Println("Failed to encode response:", err)
+			w.WriteHeader(500)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeMsgpack)
+		w.WriteHeader(status)
+		w.Write(data)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
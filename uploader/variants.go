@@ -0,0 +1,455 @@
+package uploader
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+var maxVariants = 4
+
+// maxDerivatives is MAX_DERIVATIVES, the hard cap on objects made from one
+// upload: its variants plus its alias copy. MAX_VARIANTS may not go above
+// it, and variants past it, once the alias is counted, are dropped.
+var maxDerivatives = 20
+
+// maxDecodePixels bounds the images decoded for variants. Decoding holds 4
+// bytes a pixel, so the default of 50 megapixels is about 200MB per decode
+// slot; the header is checked first, so a small file claiming a huge canvas
+// is refused before anything is allocated.
+var maxDecodePixels = 50_000_000
+
+// maxVariantSide bounds a requested box, so a typo can't ask for a canvas
+// bigger than any upload. Variants are never scaled up anyway.
+const maxVariantSide = 10000
+
+const variantJPEGQuality = 85
+
+// targetFileSize is TARGET_FILE_SIZE_KB in bytes, or 0 to encode JPEG
+// variants at variantJPEGQuality. When set, encodeJPEGTarget searches
+// targetQualityMin to targetQualityMax for the best quality that fits,
+// encoding at most targetMaxEncodes times.
+var (
+	targetFileSize   int64
+	targetQualityMin = 30
+	targetQualityMax = variantJPEGQuality
+	targetMaxEncodes = 6
+)
+
+// thumbnailExt is THUMBNAIL_FORMAT, the extension variants get when the
+// request doesn't send ?convert=, or "" to follow the original.
+var thumbnailExt string
+
+// autoRotateHeuristic is AUTO_ROTATE_HEURISTIC: turn variants of images
+// without an EXIF orientation upright when guessOrientation thinks they lie
+// on their side.
+var autoRotateHeuristic bool
+
+// sharpenAmount is how strongly SHARPEN_AFTER_RESIZE sharpens a downscaled
+// variant, or 0 when it is off.
+var sharpenAmount float64
+
+// variantSpec is one ?variants= entry. The image is scaled to fit inside
+// width x height, keeping its aspect ratio; 0 leaves a side free.
+type variantSpec struct {
+	name          string
+	width, height int
+}
+
+var variantNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// variantFormats maps ?convert= values to the extension variants get. The
+// standard library and x/image only encode JPEG and PNG; x/image decodes
+// WebP but can't write it, so webp is refused rather than offered.
+var variantFormats = map[string]string{"jpeg": ".jpg", "jpg": ".jpg", "png": ".png"}
+
+var (
+	errVariantQuota      = errors.New("Storage quota exceeded")
+	errVariantDailyQuota = errors.New("Daily upload quota exceeded")
+	errDecodePixels      = errors.New("Image has too many pixels to resize")
+)
+
+func initVariants() {
+	if maxDerivatives = envInt("MAX_DERIVATIVES", maxDerivatives); maxDerivatives > 100 {
+		fatal("Invalid MAX_DERIVATIVES: must be between 1 and 100")
+	}
+	if maxVariants = envIntMin("MAX_VARIANTS", maxVariants, 0); maxVariants > maxDerivatives {
+		fatalf("Invalid MAX_VARIANTS: must be between 0 and MAX_DERIVATIVES (%d)", maxDerivatives)
+	}
+	maxDecodePixels = envInt("MAX_DECODE_PIXELS", maxDecodePixels)
+	autoRotateHeuristic = envBool("AUTO_ROTATE_HEURISTIC")
+	switch format := strings.ToLower(getenv("THUMBNAIL_FORMAT")); format {
+	case "", "same":
+	case "webp":
+		fatal("Invalid THUMBNAIL_FORMAT: webp is not supported, there is no WebP encoder")
+	default:
+		ext, ok := variantFormats[format]
+		if !ok {
+			fatal("Invalid THUMBNAIL_FORMAT: must be same, jpeg or png")
+		}
+		thumbnailExt = ext
+	}
+	targetFileSize = int64(envIntMin("TARGET_FILE_SIZE_KB", 0, 0)) << 10
+	targetQualityMin = envInt("TARGET_QUALITY_MIN", targetQualityMin)
+	targetQualityMax = envInt("TARGET_QUALITY_MAX", targetQualityMax)
+	if targetQualityMax > 100 || targetQualityMin > targetQualityMax {
+		fatal("Invalid TARGET_QUALITY_MIN/TARGET_QUALITY_MAX: must be between 1 and 100, min at most max")
+	}
+	if targetMaxEncodes = envInt("TARGET_MAX_ENCODES", targetMaxEncodes); targetMaxEncodes > 10 {
+		fatal("Invalid TARGET_MAX_ENCODES: must be between 1 and 10")
+	}
+	if envBool("SHARPEN_AFTER_RESIZE") {
+		sharpenAmount = 0.5
+		if v := getenv("SHARPEN_AMOUNT"); v != "" {
+			amount, err := strconv.ParseFloat(v, 64)
+			if err != nil || amount <= 0 || amount > 5 {
+				fatal("Invalid SHARPEN_AMOUNT: must be a number above 0, at most 5")
+			}
+			sharpenAmount = amount
+		}
+	}
+}
+
+// parseVariants reads a list like thumb:200x200,medium:800, where a single
+// number is a width.
+func parseVariants(s string) ([]variantSpec, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if maxVariants == 0 {
+		return nil, errors.New("Variants are disabled")
+	}
+	entries := strings.Split(s, ",")
+	if len(entries) > maxVariants {
+		return nil, fmt.Errorf("At most %d variants allowed", maxVariants)
+	}
+	specs := make([]variantSpec, 0, len(entries))
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		name, size, _ := strings.Cut(strings.TrimSpace(entry), ":")
+		w, h, hasHeight := strings.Cut(size, "x")
+		spec := variantSpec{name: name}
+		var errW, errH error
+		if w != "" {
+			spec.width, errW = strconv.Atoi(w)
+		}
+		if hasHeight && h != "" {
+			spec.height, errH = strconv.Atoi(h)
+		}
+		switch {
+		case !variantNamePattern.MatchString(name):
+			return nil, fmt.Errorf("Invalid variant %q: names use a-z, 0-9, - and _", entry)
+		case seen[name]:
+			return nil, fmt.Errorf("Duplicate variant %q", name)
+		case errW != nil || errH != nil || spec.width < 0 || spec.height < 0 || spec.width+spec.height == 0,
+			spec.width > maxVariantSide || spec.height > maxVariantSide:
+			return nil, fmt.Errorf("Invalid variant %q: size must look like 200x200 or 800, up to %dpx", entry, maxVariantSide)
+		}
+		seen[name] = true
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// parseConvert returns the extension for ?convert=, or "" to keep the
+// default: THUMBNAIL_FORMAT, or when that is same, JPEG stays JPEG and
+// everything else becomes PNG.
+func parseConvert(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	if ext, ok := variantFormats[strings.ToLower(s)]; ok {
+		return ext, nil
+	}
+	if strings.EqualFold(s, "webp") {
+		return "", errors.New("convert=webp is not supported: there is no WebP encoder")
+	}
+	return "", errors.New("convert must be jpeg or png")
+}
+
+// variantKey stores a variant next to its original: uploads/a.jpg with
+// thumb becomes uploads/a_thumb.jpg.
+func variantKey(key, name, ext string) string {
+	return strings.TrimSuffix(key, filepath.Ext(key)) + "_" + name + ext
+}
+
+// fitWithin returns the size of src scaled down to fit spec.
+func fitWithin(src image.Rectangle, spec variantSpec) image.Rectangle {
+	w, h := src.Dx(), src.Dy()
+	scale := 1.0
+	if spec.width > 0 && w > spec.width {
+		scale = min(scale, float64(spec.width)/float64(w))
+	}
+	if spec.height > 0 && h > spec.height {
+		scale = min(scale, float64(spec.height)/float64(h))
+	}
+	return image.Rect(0, 0, max(1, int(float64(w)*scale+0.5)), max(1, int(float64(h)*scale+0.5)))
+}
+
+// orient turns src upright for its EXIF orientation, since variants are
+// re-encoded without the tag that told viewers to rotate them.
+func orient(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	rgba := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := range dh {
+		for x := range dw {
+			sx, sy := x, y
+			switch orientation {
+			case 2: // flip horizontally
+				sx = w - 1 - x
+			case 3: // turn 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // flip vertically
+				sy = h - 1 - y
+			case 5: // transpose
+				sx, sy = y, x
+			case 6: // turn 90° clockwise
+				sx, sy = y, h-1-x
+			case 7: // transverse
+				sx, sy = w-1-y, h-1-x
+			case 8: // turn 90° counterclockwise
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):][:4], rgba.Pix[rgba.PixOffset(sx, sy):][:4])
+		}
+	}
+	return dst
+}
+
+// guessOrientation is a best-effort EXIF orientation for an image without
+// one: 6 or 8 for a landscape frame whose content lies on its side, and 1
+// otherwise. Upright photos and text change most from top to bottom (sky to
+// ground, line to line), so content whose brightness varies far more across
+// the columns than down the rows is taken as turned 90°, and the brighter
+// side, usually sky or a page's margin, as its top. It sees a 64x64 sample,
+// so it costs the same for any size.
+func guessOrientation(src image.Image) int {
+	b := src.Bounds()
+	if b.Dx() <= b.Dy() {
+		return 1
+	}
+	const n = 64
+	var grid [n][n]float64
+	for r := range n {
+		for c := range n {
+			x := b.Min.X + (2*c+1)*b.Dx()/(2*n)
+			y := b.Min.Y + (2*r+1)*b.Dy()/(2*n)
+			grid[r][c] = float64(color.GrayModel.Convert(src.At(x, y)).(color.Gray).Y)
+		}
+	}
+	var rows, cols [n]float64
+	for r := range n {
+		for c := range n {
+			rows[r] += grid[r][c] / n
+			cols[c] += grid[r][c] / n
+		}
+	}
+	spread := func(p []float64) float64 {
+		mean := 0.0
+		for _, v := range p {
+			mean += v / float64(len(p))
+		}
+		variance := 0.0
+		for _, v := range p {
+			variance += (v - mean) * (v - mean) / float64(len(p))
+		}
+		return variance
+	}
+	if spread(cols[:]) < 4*spread(rows[:]) || spread(cols[:]) < 25 {
+		return 1
+	}
+	left, right := 0.0, 0.0
+	for c := range n / 3 {
+		left += cols[c]
+		right += cols[n-1-c]
+	}
+	switch diff := (left - right) / (n / 3); {
+	case diff > 10:
+		return 6 // top on the left: turn clockwise
+	case diff < -10:
+		return 8
+	}
+	return 1
+}
+
+// encodeVariant returns the encoded variant and, for JPEG, its quality.
+func encodeVariant(src image.Image, spec variantSpec, ext string) (*bytes.Buffer, int, error) {
+	dst := image.NewRGBA(fitWithin(src.Bounds(), spec))
+	if ext == ".jpg" {
+		// JPEG has no alpha; flatten onto white rather than black.
+		draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	}
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+	if sharpenAmount > 0 && dst.Bounds().Size() != src.Bounds().Size() {
+		sharpen(dst, sharpenAmount)
+	}
+
+	if ext != ".jpg" {
+		var buf bytes.Buffer
+		return &buf, 0, png.Encode(&buf, dst)
+	}
+	if targetFileSize > 0 {
+		return encodeJPEGTarget(dst)
+	}
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: variantJPEGQuality})
+	return &buf, variantJPEGQuality, err
+}
+
+// encodeJPEGTarget binary-searches for the highest quality whose encoding
+// fits targetFileSize, trying targetQualityMax first since small variants
+// usually fit at once. When nothing tried fits, the smallest encoding is
+// kept: the target is a goal, and the variant is still made.
+func encodeJPEGTarget(img image.Image) (*bytes.Buffer, int, error) {
+	lo, hi := targetQualityMin, targetQualityMax
+	var fit, smallest *bytes.Buffer
+	fitQuality, smallestQuality := 0, 0
+	for quality, i := hi, 0; lo <= hi && i < targetMaxEncodes; quality, i = (lo+hi+1)/2, i+1 {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, 0, err
+		}
+		if int64(buf.Len()) <= targetFileSize {
+			fit, fitQuality, lo = &buf, quality, quality+1
+			continue
+		}
+		if smallest == nil || buf.Len() < smallest.Len() {
+			smallest, smallestQuality = &buf, quality
+		}
+		hi = quality - 1
+	}
+	if fit != nil {
+		return fit, fitQuality, nil
+	}
+	return smallest, smallestQuality, nil
+}
+
+// sharpen applies an unsharp mask to img: each pixel moves away from a 3x3
+// Gaussian blur of its neighbourhood by amount times the difference. Alpha is
+// left alone, and colors stay within it since img is premultiplied.
+func sharpen(img *image.RGBA, amount float64) {
+	b := img.Bounds()
+	src := slices.Clone(img.Pix)
+	at := func(x, y, c int) float64 {
+		x = min(max(x, b.Min.X), b.Max.X-1)
+		y = min(max(y, b.Min.Y), b.Max.Y-1)
+		return float64(src[img.PixOffset(x, y)+c])
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			alpha := float64(src[i+3])
+			for c := range 3 {
+				blur := (4*at(x, y, c) +
+					2*(at(x-1, y, c)+at(x+1, y, c)+at(x, y-1, c)+at(x, y+1, c)) +
+					at(x-1, y-1, c) + at(x+1, y-1, c) + at(x-1, y+1, c) + at(x+1, y+1, c)) / 16
+				v := at(x, y, c) + amount*(at(x, y, c)-blur)
+				img.Pix[i+c] = uint8(min(max(v, 0), alpha) + 0.5)
+			}
+		}
+	}
+}
+
+// storeVariants decodes file once and uploads every requested variant of
+// key. It stops at the first failure and returns the variants stored so far,
+// by name, along with their keys. Under TARGET_FILE_SIZE_KB it also returns
+// the quality and size each JPEG variant ended up with.
+func (job *uploadJob) storeVariants(file io.ReadSeeker, key, contentType string, variants []variantSpec) (map[string]string, []string, map[string]TunedVariant, error) {
+	header := readImageMetadata(job.ctx, file)
+	if header == nil {
+		return nil, nil, nil, errors.New("unreadable image header")
+	}
+	if int64(header.Width)*int64(header.Height) > int64(maxDecodePixels) {
+		return nil, nil, nil, errDecodePixels
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, nil, err
+	}
+	var src image.Image
+	err := withDecodeSlot(job.ctx, func() (err error) {
+		if src, _, err = image.Decode(file); err != nil {
+			return err
+		}
+		orientation := header.Orientation
+		if !header.tagged && autoRotateHeuristic {
+			orientation = guessOrientation(src)
+		}
+		src = orient(src, orientation)
+		return err
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	ext := cmp.Or(job.variantExt, thumbnailExt)
+	if ext == "" {
+		ext = ".png"
+		if contentType == "image/jpeg" {
+			ext = ".jpg"
+		}
+	}
+
+	urls := map[string]string{}
+	var keys []string
+	var tuned map[string]TunedVariant
+	for _, spec := range variants {
+		var buf *bytes.Buffer
+		var quality int
+		if err := withDecodeSlot(job.ctx, func() (err error) {
+			buf, quality, err = encodeVariant(src, spec, ext)
+			return err
+		}); err != nil {
+			return urls, keys, tuned, err
+		}
+
+		size := int64(buf.Len())
+		if _, err := reserveQuota(job.label, size); err != nil {
+			return urls, keys, tuned, errVariantQuota
+		}
+		if _, err := reserveDailyQuota(job.label, size); err != nil {
+			releaseQuota(job.label, size)
+			return urls, keys, tuned, errVariantDailyQuota
+		}
+		vkey := variantKey(key, spec.name, ext)
+		ctx, cancel := withOptionalTimeout(job.ctx, uploadTimeout)
+		url, err := uploadToR2(ctx, bytes.NewReader(buf.Bytes()), size, vkey, UploadOptions{Metadata: job.meta})
+		cancel()
+		if err != nil {
+			releaseQuota(job.label, size)
+			releaseDailyQuota(job.label, size)
+			return urls, keys, tuned, err
+		}
+		urls[spec.name] = url
+		keys = append(keys, vkey)
+		if targetFileSize > 0 && ext == ".jpg" {
+			if tuned == nil {
+				tuned = map[string]TunedVariant{}
+			}
+			tuned[spec.name] = TunedVariant{Quality: quality, Size: size, TargetMet: size <= targetFileSize}
+		}
+	}
+	return urls, keys, tuned, nil
+}
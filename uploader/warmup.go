@@ -0,0 +1,32 @@
+package uploader
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+var warmupTimeout = 10 * time.Second
+
+// warmUp pings each backend (a HeadBucket on S3), so the TLS handshake is
+// pooled before the listener accepts the first upload. It runs before the
+// server starts, so health checks only pass once it is done. Failures are
+// logged, not fatal: the first upload then just pays the cost.
+func warmUp() {
+	warmupTimeout = envDuration("WARMUP_TIMEOUT", warmupTimeout)
+	warmBucket("R2", storage)
+	if fallback != nil {
+		warmBucket("Fallback backend", fallback.Storage)
+	}
+}
+
+func warmBucket(name string, store Storage) {
+	ctx, cancel := withOptionalTimeout(context.Background(), warmupTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := store.Ping(ctx); err != nil {
+		log.Println(name, "warm-up failed, continuing:", err)
+		return
+	}
+	log.Println(name, "connection warmed up in", time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,218 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A webhookQueue delivers upload events to WEBHOOK_URL from a single
+// background worker, so a slow or failing receiver never delays an upload
+// response. Events are queued in memory; ones still pending at shutdown are
+// lost once SHUTDOWN_TIMEOUT has passed, when abort cancels ctx.
+type webhookQueue struct {
+	url         string
+	secret      []byte
+	client      *http.Client
+	maxAttempts int
+	ctx         context.Context
+	abort       context.CancelFunc
+
+	mu     sync.Mutex
+	events chan webhookEvent
+	closed bool
+	done   chan struct{}
+}
+
+type webhookEvent struct {
+	id   string
+	body []byte
+}
+
+type WebhookFile struct {
+	Key          string `json:"key"`
+	URL          string `json:"url"`
+	Size         int64  `json:"size"`
+	ContentType  string `json:"content_type"`
+	Deduplicated bool   `json:"deduplicated,omitempty"`
+}
+
+type webhookPayload struct {
+	ID        string        `json:"id"`
+	Event     string        `json:"event"`
+	Timestamp time.Time     `json:"timestamp"`
+	RequestID string        `json:"request_id,omitempty"`
+	KeyLabel  string        `json:"key_label"`
+	Files     []WebhookFile `json:"files"`
+}
+
+// webhookMaxBackoff caps the wait between attempts.
+const webhookMaxBackoff = 5 * time.Minute
+
+func initWebhooks() *webhookQueue {
+	endpoint := getenv("WEBHOOK_URL")
+	if endpoint == "" {
+		return nil
+	}
+	target, err := url.Parse(endpoint)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		fatal("Invalid WEBHOOK_URL: must be an http or https URL")
+	}
+	secret := getenv("WEBHOOK_SECRET")
+	if secret != "" && len(secret) < 32 {
+		fatal("Invalid WEBHOOK_SECRET: must be at least 32 characters")
+	}
+	webhooks := &webhookQueue{
+		url:         endpoint,
+		secret:      []byte(secret),
+		client:      &http.Client{Timeout: envDuration("WEBHOOK_TIMEOUT", 10*time.Second)},
+		maxAttempts: envInt("WEBHOOK_MAX_ATTEMPTS", 5),
+		events:      make(chan webhookEvent, envInt("WEBHOOK_QUEUE_SIZE", 1000)),
+		done:        make(chan struct{}),
+	}
+	webhooks.ctx, webhooks.abort = context.WithCancel(context.Background())
+	go webhooks.run()
+	// Only the host is logged: the URL may carry a token.
+	log.Println("Upload webhooks enabled:", target.Host)
+	return webhooks
+}
+
+// notifyUpload queues an upload.completed event for the files one request
+// stored. A full queue drops the event rather than block the request, and so
+// does one that has been drained for shutdown.
+func notifyUpload(r *http.Request, label string, files []WebhookFile) {
+	s := serverFrom(r)
+	if s == nil || s.webhooks == nil || len(files) == 0 {
+		return
+	}
+	payload := webhookPayload{
+		ID:        uuid.NewString(),
+		Event:     "upload.completed",
+		Timestamp: time.Now().UTC(),
+		RequestID: requestID(r),
+		KeyLabel:  label,
+		Files:     files,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Println("Failed to encode webhook:", err)
+		return
+	}
+	if camelCaseFields {
+		body = camelizeKeys(body)
+	}
+	if !s.webhooks.add(webhookEvent{id: payload.ID, body: body}) {
+		log.Printf("Webhook queue full, dropping event %s (request %s)", payload.ID, payload.RequestID)
+	}
+}
+
+func (q *webhookQueue) add(ev webhookEvent) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	select {
+	case q.events <- ev:
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *webhookQueue) run() {
+	defer close(q.done)
+	for ev := range q.events {
+		if q.ctx.Err() != nil {
+			log.Printf("Webhook %s not sent: shutdown timeout reached", ev.id)
+			continue
+		}
+		q.deliver(ev)
+	}
+}
+
+// deliver posts ev until the receiver answers 2xx, waiting 1s, 2s, 4s and so
+// on between attempts. 4xx answers other than 408 and 429 are not retried,
+// since sending the same body again won't change them.
+func (q *webhookQueue) deliver(ev webhookEvent) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		status, err := q.post(ev)
+		if err == nil && status/100 == 2 {
+			return
+		}
+		retryable := err != nil || status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+		if err == nil {
+			err = fmt.Errorf("receiver answered %d", status)
+		}
+		if !retryable || attempt >= q.maxAttempts {
+			log.Printf("Webhook %s failed after %d attempt(s): %v", ev.id, attempt, err)
+			return
+		}
+		log.Printf("Webhook %s attempt %d failed, retrying in %s: %v", ev.id, attempt, backoff, err)
+		wait := time.NewTimer(backoff)
+		select {
+		case <-wait.C:
+		case <-q.ctx.Done():
+			wait.Stop()
+			log.Printf("Webhook %s not retried: shutdown timeout reached", ev.id)
+			return
+		}
+		backoff = min(backoff*2, webhookMaxBackoff)
+	}
+}
+
+func (q *webhookQueue) post(ev webhookEvent) (int, error) {
+	req, err := http.NewRequestWithContext(q.ctx, http.MethodPost, q.url, bytes.NewReader(ev.body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "image-upload-service")
+	req.Header.Set("X-Webhook-ID", ev.id)
+	if len(q.secret) > 0 {
+		// The timestamp is signed with the body so receivers can reject
+		// replays of an old delivery.
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, q.secret)
+		mac.Write([]byte(ts + "."))
+		mac.Write(ev.body)
+		req.Header.Set("X-Webhook-Timestamp", ts)
+		req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
+
+// drain stops taking events and waits until the queued ones are delivered,
+// or abort has given up on them.
+func (q *webhookQueue) drain() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.events)
+	}
+	q.mu.Unlock()
+	<-q.done
+}
@@ -0,0 +1,157 @@
+package uploader
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type ZipRequest struct {
+	Keys []string `json:"keys"`
+}
+
+var zipMaxKeys = 100
+var zipMissingPolicy = "skip"
+
+func initZip() {
+	zipMaxKeys = envInt("ZIP_MAX_KEYS", zipMaxKeys)
+	if policy := getenv("ZIP_MISSING_POLICY"); policy != "" {
+		if policy != "skip" && policy != "fail" {
+			fatal("Invalid ZIP_MISSING_POLICY: must be skip or fail")
+		}
+		zipMissingPolicy = policy
+	}
+}
+
+// isManagedKey reports whether key is a plain object key inside prefix, so
+// callers can't reach anything else in the bucket.
+func isManagedKey(prefix, key string) bool {
+	if !strings.HasPrefix(key, prefix) || len(key) == len(prefix) {
+		return false
+	}
+	return path.Clean(key) == key && !strings.Contains(key, "..")
+}
+
+func isNotFound(err error) bool {
+	var noKey *types.NoSuchKey
+	var notFound *types.NotFound
+	return errors.As(err, &noKey) || errors.As(err, &notFound) || errors.Is(err, fs.ErrNotExist)
+}
+
+func downloadZipHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) || !allowOperation(w, r, opList) {
+		return
+	}
+
+	var req ZipRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		sendJSONMulti(w, 400, nil, nil, "Invalid JSON body")
+		return
+	}
+	if len(req.Keys) == 0 {
+		sendJSONMulti(w, 400, nil, nil, "At least 1 key required")
+		return
+	}
+	if len(req.Keys) > zipMaxKeys {
+		sendJSONMulti(w, 400, nil, nil, fmt.Sprintf("Maximum %d keys allowed", zipMaxKeys))
+		return
+	}
+	prefix := uploadPrefixFor(keyLabel(r))
+	for _, key := range req.Keys {
+		if !ownsKey(keyLabel(r), key) {
+			sendJSONMulti(w, 400, nil, []string{key + ": Invalid key"}, "Keys must be under "+prefix)
+			return
+		}
+	}
+
+	// Once the archive starts streaming the status is already 200, so the
+	// fail policy has to find missing keys up front.
+	if zipMissingPolicy == "fail" {
+		var missing []string
+		for _, key := range req.Keys {
+			_, err := routeRead(func(store Storage) (StoredObject, error) {
+				return store.Head(r.Context(), key)
+			})
+			if isNotFound(err) {
+				missing = append(missing, key+": Not found")
+			} else if err != nil {
+				sendJSONMulti(w, 502, nil, []string{key + ": Lookup failed"}, "Failed to read objects")
+				return
+			}
+		}
+		if len(missing) > 0 {
+			sendJSONMulti(w, 404, nil, missing, "Some keys were not found")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="images.zip"`)
+	zw := zip.NewWriter(w)
+
+	var warnings []string
+	seen := map[string]bool{}
+	for _, key := range req.Keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if err := writeZipEntry(r.Context(), zw, prefix, key); err != nil {
+			if zipMissingPolicy == "fail" || !isNotFound(err) {
+				log.Println("ZIP download aborted at", key+":", err)
+				panic(http.ErrAbortHandler)
+			}
+			warnings = append(warnings, key+": not found, skipped")
+		}
+	}
+
+	if len(warnings) > 0 {
+		if entry, err := zw.Create("MISSING.txt"); err == nil {
+			io.WriteString(entry, strings.Join(warnings, "\n")+"\n")
+		}
+	}
+	zw.Close()
+}
+
+func writeZipEntry(ctx context.Context, zw *zip.Writer, prefix, key string) error {
+	type object struct {
+		body io.ReadCloser
+		info StoredObject
+	}
+	obj, err := routeRead(func(store Storage) (object, error) {
+		body, info, err := store.Get(ctx, key)
+		return object{body, info}, err
+	})
+	if err != nil {
+		return err
+	}
+	defer obj.body.Close()
+
+	// Images are already compressed, so store them rather than deflate.
+	header := &zip.FileHeader{
+		Name:     strings.TrimPrefix(key, prefix),
+		Method:   zip.Store,
+		Modified: obj.info.LastModified,
+	}
+	if header.Modified.IsZero() {
+		header.Modified = time.Now()
+	}
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, obj.body)
+	return err
+}